@@ -0,0 +1,12 @@
+package main
+
+import "net/http"
+
+// requestActor returns who is performing the request, as sent by the frontend in the X-Actor header
+func requestActor(r *http.Request) string {
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		return "unknown"
+	}
+	return actor
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PaymentAllocation is the part of a payment applied to one invoice
+type PaymentAllocation struct {
+	InvoiceID string  `bson:"invoiceId" json:"invoiceId"`
+	Amount    float64 `bson:"amount" json:"amount"`
+}
+
+var ErrInvalidPayment = errors.New("invalid payment")
+
+// roundMoney rounds an amount to cents so repeated additions do not drift
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// invoiceDue is what is still owed on an invoice, including late fees, after payments and credit notes
+func invoiceDue(invoice InvoiceGet) float64 {
+	return roundMoney(invoice.Total + invoice.LateFees - invoice.AmountPaid - invoice.Credited)
+}
+
+// openInvoiceFilter matches a customer's invoices that can still receive payments
+func openInvoiceFilter(custID primitive.ObjectID) bson.M {
+	return bson.M{"custId": custID, "status": bson.M{"$nin": []string{InvoiceDraft, InvoicePaid, InvoiceVoid}}}
+}
+
+// planAllocations decides how amount is spread over a customer's invoices.
+// Explicit allocations are validated against what each invoice still owes; without them the
+// amount is applied to the oldest open invoices first. Whatever is left over becomes credit.
+func planAllocations(client *mongo.Client, custID primitive.ObjectID, amount float64, requested []PaymentAllocation) ([]PaymentAllocation, error) {
+	collection := client.Database(Database).Collection("invoices")
+
+	if len(requested) > 0 {
+		total := 0.0
+		seen := map[string]bool{}
+		for _, allocation := range requested {
+			if allocation.Amount <= 0 {
+				return nil, fmt.Errorf("%w: allocation to %s must be positive", ErrInvalidPayment, allocation.InvoiceID)
+			}
+			if seen[allocation.InvoiceID] {
+				return nil, fmt.Errorf("%w: invoice %s allocated twice", ErrInvalidPayment, allocation.InvoiceID)
+			}
+			seen[allocation.InvoiceID] = true
+
+			oid, err := primitive.ObjectIDFromHex(allocation.InvoiceID)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidPayment, err.Error())
+			}
+			var invoice InvoiceGet
+			filter := openInvoiceFilter(custID)
+			filter["_id"] = oid
+			err = collection.FindOne(context.Background(), filter).Decode(&invoice)
+			if err == mongo.ErrNoDocuments {
+				return nil, fmt.Errorf("%w: invoice %s is not open for this customer", ErrInvalidPayment, allocation.InvoiceID)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if roundMoney(allocation.Amount) > invoiceDue(invoice) {
+				return nil, fmt.Errorf("%w: allocation to %s exceeds the %.2f outstanding", ErrInvalidPayment, allocation.InvoiceID, invoiceDue(invoice))
+			}
+			total += allocation.Amount
+		}
+		if roundMoney(total) > roundMoney(amount) {
+			return nil, fmt.Errorf("%w: allocations total %.2f exceeds payment of %.2f", ErrInvalidPayment, total, amount)
+		}
+		return requested, nil
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(context.Background(), openInvoiceFilter(custID), findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var invoices []InvoiceGet
+	err = cursor.All(context.Background(), &invoices)
+	if err != nil {
+		return nil, err
+	}
+	return spreadAllocations(invoices, amount), nil
+}
+
+// spreadAllocations applies amount to invoices in the order given until it runs out, skipping
+// any that are already settled
+func spreadAllocations(invoices []InvoiceGet, amount float64) []PaymentAllocation {
+	var allocations []PaymentAllocation
+	remaining := roundMoney(amount)
+	for _, invoice := range invoices {
+		if remaining <= 0 {
+			break
+		}
+		due := invoiceDue(invoice)
+		if due <= 0 {
+			continue
+		}
+		applied := math.Min(due, remaining)
+		allocations = append(allocations, PaymentAllocation{InvoiceID: invoice.ID.Hex(), Amount: applied})
+		remaining = roundMoney(remaining - applied)
+	}
+	return allocations
+}
+
+// allocatedTotal sums the amounts of a set of allocations
+func allocatedTotal(allocations []PaymentAllocation) float64 {
+	total := 0.0
+	for _, allocation := range allocations {
+		total += allocation.Amount
+	}
+	return roundMoney(total)
+}
+
+// postInvoiceAmount adds amount (negative to take it back) to an invoice's amountpaid, credited or
+// latefees field, recomputes its amount due and records the change in its history. The update is done as a
+// pipeline so invoices written before amounts were tracked are handled atomically as well.
+func postInvoiceAmount(client *mongo.Client, invoiceID string, field string, amount float64, eventType string, ref string, actor string) error {
+	oid, err := primitive.ObjectIDFromHex(invoiceID)
+	if err != nil {
+		return err
+	}
+	event := InvoiceEvent{Type: eventType, Amount: amount, Ref: ref, Actor: actor, At: time.Now()}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"amountpaid": bson.M{"$ifNull": bson.A{"$amountpaid", 0}},
+			"credited":   bson.M{"$ifNull": bson.A{"$credited", 0}},
+			"latefees":   bson.M{"$ifNull": bson.A{"$latefees", 0}},
+			"history":    bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$history", bson.A{}}}, bson.A{bson.M{"$literal": event}}}},
+			"version":    bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+		}},
+		bson.M{"$set": bson.M{field: bson.M{"$round": bson.A{bson.M{"$add": bson.A{"$" + field, amount}}, 2}}}},
+		bson.M{"$set": bson.M{"amountdue": bson.M{"$round": bson.A{bson.M{"$subtract": bson.A{bson.M{"$add": bson.A{"$total", "$latefees"}}, bson.M{"$add": bson.A{"$amountpaid", "$credited"}}}}, 2}}}},
+	}
+	collection := client.Database(Database).Collection("invoices")
+	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": oid}, update)
+	if err != nil {
+		return err
+	}
+	return settleInvoiceStatus(client, oid, actor)
+}
+
+// applyAllocations posts each allocation to its invoice
+func applyAllocations(client *mongo.Client, allocations []PaymentAllocation, ref string, actor string) error {
+	for _, allocation := range allocations {
+		err := postInvoiceAmount(client, allocation.InvoiceID, "amountpaid", allocation.Amount, "allocation", ref, actor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAllocations takes a payment's allocations back off its invoices
+func releaseAllocations(client *mongo.Client, allocations []PaymentAllocation, ref string, actor string) error {
+	for _, allocation := range allocations {
+		err := postInvoiceAmount(client, allocation.InvoiceID, "amountpaid", -allocation.Amount, "allocation_released", ref, actor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustCredit atomically adds delta to a customer's unallocated credit
+func adjustCredit(client *mongo.Client, custID primitive.ObjectID, delta float64) error {
+	if delta == 0 {
+		return nil
+	}
+	collection := client.Database(Database).Collection("customer")
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": custID}, bson.M{"$inc": bson.M{"credit": delta, "version": 1}})
+	return err
+}
+
+// spendPaymentCredit records credit spent on invoices against the payments it came from, oldest
+// first. Each payment's share moves out of its credit and into its allocations, so refunding the
+// payment later takes it back off those invoices rather than out of credit that is already gone.
+func spendPaymentCredit(client *mongo.Client, custID primitive.ObjectID, allocations []PaymentAllocation) error {
+	collection := client.Database(Database).Collection("payments")
+	findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(context.Background(), bson.M{"customerid": custID.Hex(), "credit": bson.M{"$gt": 0}}, findOptions)
+	if err != nil {
+		return nothingChanged(err)
+	}
+	var payments []PaymentCaptureGet
+	err = cursor.All(context.Background(), &payments)
+	if err != nil {
+		return nothingChanged(err)
+	}
+
+	pending := append([]PaymentAllocation{}, allocations...)
+	for i, payment := range payments {
+		available := payment.Credit
+		var spent []PaymentAllocation
+		for len(pending) > 0 && available > 0 {
+			take := math.Min(pending[0].Amount, available)
+			spent = append(spent, PaymentAllocation{InvoiceID: pending[0].InvoiceID, Amount: take})
+			available = roundMoney(available - take)
+			pending[0].Amount = roundMoney(pending[0].Amount - take)
+			if pending[0].Amount <= 0 {
+				pending = pending[1:]
+			}
+		}
+		if len(spent) == 0 {
+			break
+		}
+		filter := bson.M{"_id": payment.ID, "credit": payment.Credit}
+		update := bumpVersion(bson.M{"$set": bson.M{"credit": available}, "$push": bson.M{"allocations": bson.M{"$each": spent}}})
+		result, err := collection.UpdateOne(context.Background(), filter, update)
+		if err != nil && i == 0 {
+			return nothingChanged(err)
+		}
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return fmt.Errorf("%w: payment %s changed while applying credit, try again", ErrInvalidPayment, payment.ID.Hex())
+		}
+	}
+	return nil
+}
+
+// applyCustomerCredit spends a customer's credit on their oldest open invoices.
+// The balance already reflects the credit, so only the invoices, the credit and the payments the
+// credit came from change.
+func applyCustomerCredit(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var cust CustomerGet
+		err = client.Database(Database).Collection("customer").FindOne(context.Background(), bson.M{"_id": oid}).Decode(&cust)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cust.Credit <= 0 {
+			http.Error(w, "customer has no credit", http.StatusConflict)
+			return
+		}
+
+		allocations, err := planAllocations(client, oid, cust.Credit, nil)
+		if err != nil {
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = spendPaymentCredit(client, oid, allocations)
+		if err != nil {
+			log.Println(err.Error())
+			releaseIfUnchanged(w, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = adjustCredit(client, oid, -allocatedTotal(allocations))
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = applyAllocations(client, allocations, "credit", requestActor(r))
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(allocations)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRoundMoney(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   float64
+	}{
+		{amount: 0.1 + 0.2, want: 0.3},
+		{amount: 10.005, want: 10.01},
+		{amount: -4.444, want: -4.44},
+		{amount: 7, want: 7},
+	}
+	for _, tt := range tests {
+		if got := roundMoney(tt.amount); got != tt.want {
+			t.Errorf("roundMoney(%v) = %v, want %v", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestInvoiceDue(t *testing.T) {
+	invoice := InvoiceGet{Total: 100, LateFees: 5.5, AmountPaid: 40.25, Credited: 10}
+	if got := invoiceDue(invoice); got != 55.25 {
+		t.Errorf("invoiceDue() = %v, want 55.25", got)
+	}
+}
+
+func TestSpreadAllocations(t *testing.T) {
+	first := InvoiceGet{ID: primitive.NewObjectID(), Total: 50}
+	settled := InvoiceGet{ID: primitive.NewObjectID(), Total: 30, AmountPaid: 30}
+	second := InvoiceGet{ID: primitive.NewObjectID(), Total: 80, AmountPaid: 20}
+	invoices := []InvoiceGet{first, settled, second}
+
+	tests := []struct {
+		name   string
+		amount float64
+		want   []PaymentAllocation
+	}{
+		{name: "covers part of the oldest", amount: 20, want: []PaymentAllocation{{InvoiceID: first.ID.Hex(), Amount: 20}}},
+		{name: "skips settled invoices", amount: 70, want: []PaymentAllocation{
+			{InvoiceID: first.ID.Hex(), Amount: 50},
+			{InvoiceID: second.ID.Hex(), Amount: 20},
+		}},
+		{name: "leaves the rest as credit", amount: 150, want: []PaymentAllocation{
+			{InvoiceID: first.ID.Hex(), Amount: 50},
+			{InvoiceID: second.ID.Hex(), Amount: 60},
+		}},
+		{name: "nothing to spread", amount: 0, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spreadAllocations(invoices, tt.amount); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spreadAllocations(%v) = %v, want %v", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocatedTotal(t *testing.T) {
+	allocations := []PaymentAllocation{{Amount: 0.1}, {Amount: 0.2}, {Amount: 12.5}}
+	if got := allocatedTotal(allocations); got != 12.8 {
+		t.Errorf("allocatedTotal() = %v, want 12.8", got)
+	}
+}
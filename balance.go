@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// adjustBalance atomically adds delta to a customer's balance and returns the new balance
+func adjustBalance(client *mongo.Client, custID primitive.ObjectID, delta float64) (float64, error) {
+	collection := client.Database(Database).Collection("customer")
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var cust CustomerGet
+	err := collection.FindOneAndUpdate(context.Background(), bson.M{"_id": custID}, bson.M{"$inc": bson.M{"balance": delta, "version": 1}}, opts).Decode(&cust)
+	if err != nil {
+		return 0, err
+	}
+	return cust.Balance, nil
+}
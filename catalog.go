@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Variant is a sellable version of an item, such as a size or color, with its own price and stock
+type Variant struct {
+	SKU          string            `bson:"sku,omitempty" json:"sku"`
+	Name         string            `bson:"name" json:"name"`
+	Attributes   map[string]string `bson:"attributes" json:"attributes"`
+	Price        float64           `bson:"price" json:"price"`
+	Stock        int64             `bson:"stock" json:"stock"`
+	ReorderLevel int64             `bson:"reorderlevel" json:"reorderLevel"`
+}
+
+// Units are the units of measure an item can be sold in
+var Units = []string{"pcs", "kg", "g", "l", "ml", "m", "cm", "box", "pack", "set", "pair", "dozen"}
+
+type Category struct {
+	Name              string             `json:"name"`
+	ParentID          primitive.ObjectID `bson:"parentId,omitempty" json:"parentId,omitempty"`
+	TaxRate           *float64           `bson:"taxrate,omitempty" json:"taxRate,omitempty"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type CategoryGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Name              string             `json:"name"`
+	ParentID          primitive.ObjectID `bson:"parentId,omitempty" json:"parentId,omitempty"`
+	TaxRate           *float64           `bson:"taxrate,omitempty" json:"taxRate,omitempty"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	Path              string             `bson:"-" json:"path"`
+	Children          []CategoryGet      `bson:"-" json:"children,omitempty"`
+}
+
+var (
+	ErrInvalidItem = errors.New("invalid item")
+	ErrSKUTaken    = errors.New("SKU is already used by another item")
+)
+
+// validateCatalogFields checks the unit, category and SKUs of the item itemID (zero for a new
+// one) before it is saved. The unique indexes on sku and variants.sku each only see their own
+// field; this catches the cases they cannot, such as two variants of one item sharing a SKU or
+// an item's SKU matching another item's variant.
+func validateCatalogFields(client *mongo.Client, itemID primitive.ObjectID, unit string, categoryID primitive.ObjectID, sku string, variants []Variant) error {
+	if unit != "" {
+		known := false
+		for _, u := range Units {
+			if u == unit {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown unit %q, expected one of %s", ErrInvalidItem, unit, strings.Join(Units, ", "))
+		}
+	}
+
+	if !categoryID.IsZero() {
+		count, err := client.Database(Database).Collection("categories").CountDocuments(context.Background(), bson.M{"_id": categoryID})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: category %s does not exist", ErrInvalidItem, categoryID.Hex())
+		}
+	}
+
+	seen := map[string]bool{}
+	if sku != "" {
+		seen[sku] = true
+	}
+	for _, variant := range variants {
+		if variant.SKU == "" {
+			return fmt.Errorf("%w: every variant needs a SKU", ErrInvalidItem)
+		}
+		if seen[variant.SKU] {
+			return fmt.Errorf("%w: SKU %s is used more than once", ErrInvalidItem, variant.SKU)
+		}
+		seen[variant.SKU] = true
+	}
+
+	if len(seen) > 0 {
+		var skus []string
+		for s := range seen {
+			skus = append(skus, s)
+		}
+		filter := bson.M{"_id": bson.M{"$ne": itemID}, "$or": bson.A{bson.M{"sku": bson.M{"$in": skus}}, bson.M{"variants.sku": bson.M{"$in": skus}}}}
+		var other ItemGet
+		err := client.Database(Database).Collection("products").FindOne(context.Background(), filter).Decode(&other)
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrSKUTaken, other.Name)
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemErrorStatus maps errors from saving an item to HTTP statuses
+func itemErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidItem):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrSKUTaken), mongo.IsDuplicateKeyError(err):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// itemErrorMessage turns duplicate key errors into a message the frontend can show
+func itemErrorMessage(err error) string {
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrSKUTaken.Error()
+	}
+	return err.Error()
+}
+
+// addCategory creates a category, optionally under a parent category
+func addCategory(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var item Category
+		err := json.NewDecoder(r.Body).Decode(&item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		item.Name = strings.TrimSpace(item.Name)
+		if item.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if item.TaxRate != nil && (*item.TaxRate < 0 || *item.TaxRate > 100) {
+			http.Error(w, "taxRate must be a percentage between 0 and 100", http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("categories")
+		if !item.ParentID.IsZero() {
+			count, err := collection.CountDocuments(context.Background(), bson.M{"_id": item.ParentID})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if count == 0 {
+				http.Error(w, "parent category does not exist", http.StatusBadRequest)
+				return
+			}
+		}
+
+		item.CapturedTimestamp = time.Now()
+		_, err = collection.InsertOne(context.Background(), item)
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "a category with this name already exists under the same parent", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// loadCategories returns every category with its full path filled in
+func loadCategories(client *mongo.Client) ([]CategoryGet, error) {
+	collection := client.Database(Database).Collection("categories")
+	findOptions := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var categories []CategoryGet
+	err = cursor.All(context.Background(), &categories)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[primitive.ObjectID]CategoryGet{}
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+	for i := range categories {
+		names := []string{categories[i].Name}
+		parent := categories[i].ParentID
+		// Bounded by the number of categories so a bad parent loop cannot hang the request
+		for depth := 0; !parent.IsZero() && depth < len(categories); depth++ {
+			p, ok := byID[parent]
+			if !ok {
+				break
+			}
+			names = append([]string{p.Name}, names...)
+			parent = p.ParentID
+		}
+		categories[i].Path = strings.Join(names, " / ")
+	}
+	return categories, nil
+}
+
+// categoryTree nests categories under their parents
+func categoryTree(categories []CategoryGet, parent primitive.ObjectID) []CategoryGet {
+	var nodes []CategoryGet
+	for _, category := range categories {
+		if category.ParentID == parent {
+			category.Children = categoryTree(categories, category.ID)
+			nodes = append(nodes, category)
+		}
+	}
+	return nodes
+}
+
+// getCategories lists categories flat with their paths, or nested with ?tree=true
+func getCategories(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		categories, err := loadCategories(client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("tree") == "true" {
+			categories = categoryTree(categories, primitive.NilObjectID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(categories)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// editCategory renames a category or moves it under another parent
+func editCategory(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var item Category
+		err = json.NewDecoder(r.Body).Decode(&item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		item.Name = strings.TrimSpace(item.Name)
+		if item.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		// Walk up from the new parent to make sure the category is not moved under itself
+		categories, err := loadCategories(client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byID := map[primitive.ObjectID]CategoryGet{}
+		for _, category := range categories {
+			byID[category.ID] = category
+		}
+		parent := item.ParentID
+		for depth := 0; !parent.IsZero() && depth <= len(categories); depth++ {
+			if parent == oid {
+				http.Error(w, "a category cannot be moved under itself", http.StatusConflict)
+				return
+			}
+			p, ok := byID[parent]
+			if !ok {
+				http.Error(w, "parent category does not exist", http.StatusBadRequest)
+				return
+			}
+			parent = p.ParentID
+		}
+
+		if item.TaxRate != nil && (*item.TaxRate < 0 || *item.TaxRate > 100) {
+			http.Error(w, "taxRate must be a percentage between 0 and 100", http.StatusBadRequest)
+			return
+		}
+
+		// A category without a parent or tax rate of its own has those fields removed
+		set := bson.M{"name": item.Name}
+		unset := bson.M{}
+		if item.ParentID.IsZero() {
+			unset["parentId"] = ""
+		} else {
+			set["parentId"] = item.ParentID
+		}
+		if item.TaxRate == nil {
+			unset["taxrate"] = ""
+		} else {
+			set["taxrate"] = *item.TaxRate
+		}
+		update := bson.M{"$set": set}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		collection := client.Database(Database).Collection("categories")
+		result, err := collection.UpdateOne(context.Background(), bson.M{"_id": oid}, update)
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "a category with this name already exists under the same parent", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result.MatchedCount == 0 {
+			http.Error(w, "category not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// deleteCategory removes a category that has no subcategories and no items
+func deleteCategory(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("categories")
+		children, err := collection.CountDocuments(context.Background(), bson.M{"parentId": oid})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		items, err := client.Database(Database).Collection("products").CountDocuments(context.Background(), bson.M{"categoryId": oid})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if children > 0 || items > 0 {
+			http.Error(w, fmt.Sprintf("category still has %d subcategories and %d items", children, items), http.StatusConflict)
+			return
+		}
+
+		_, err = collection.DeleteOne(context.Background(), bson.M{"_id": oid})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// migrateItemTypes turns each distinct free-form Item.Type into a top-level category and points
+// the items with that type at it. Items that already have a category are left alone, so it is
+// safe to run more than once.
+func migrateItemTypes(client *mongo.Client) (int64, error) {
+	products := client.Database(Database).Collection("products")
+	categories := client.Database(Database).Collection("categories")
+
+	types, err := products.Distinct(context.Background(), "type", bson.M{"type": bson.M{"$nin": bson.A{"", nil}}})
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int64
+	for _, t := range types {
+		name, ok := t.(string)
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			continue
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		filter := bson.M{"name": name, "parentId": bson.M{"$exists": false}}
+		update := bson.M{"$setOnInsert": bson.M{"name": name, "timestamp": time.Now()}}
+		var category CategoryGet
+		err = categories.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&category)
+		if err != nil {
+			return migrated, err
+		}
+
+		result, err := products.UpdateMany(context.Background(),
+			bson.M{"type": t, "categoryId": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"categoryId": category.ID}})
+		if err != nil {
+			return migrated, err
+		}
+		migrated += result.ModifiedCount
+	}
+	return migrated, nil
+}
+
+// migrateItemTypesHandler runs migrateItemTypes on demand
+func migrateItemTypesHandler(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		migrated, err := migrateItemTypes(client)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]int64{"migrated": migrated})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
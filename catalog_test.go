@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCategoryTree(t *testing.T) {
+	stationery, pens, paper, toys := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	categories := []CategoryGet{
+		{ID: stationery, Name: "Stationery"},
+		{ID: pens, Name: "Pens", ParentID: stationery},
+		{ID: toys, Name: "Toys"},
+		{ID: paper, Name: "Paper", ParentID: stationery},
+	}
+	want := []CategoryGet{
+		{ID: stationery, Name: "Stationery", Children: []CategoryGet{
+			{ID: pens, Name: "Pens", ParentID: stationery},
+			{ID: paper, Name: "Paper", ParentID: stationery},
+		}},
+		{ID: toys, Name: "Toys"},
+	}
+	if got := categoryTree(categories, primitive.NilObjectID); !reflect.DeepEqual(got, want) {
+		t.Errorf("categoryTree() = %+v, want %+v", got, want)
+	}
+	if got := categoryTree(categories, pens); got != nil {
+		t.Errorf("categoryTree() under a leaf = %+v, want nil", got)
+	}
+}
+
+func TestItemErrorStatus(t *testing.T) {
+	duplicate := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "invalid item", err: fmt.Errorf("%w: every variant needs a SKU", ErrInvalidItem), want: http.StatusBadRequest},
+		{name: "duplicate SKU", err: duplicate, want: http.StatusConflict},
+		{name: "SKU used as another item's variant", err: fmt.Errorf("%w: Blue pen", ErrSKUTaken), want: http.StatusConflict},
+		{name: "anything else", err: errors.New("connection reset"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := itemErrorStatus(tt.err); got != tt.want {
+				t.Errorf("itemErrorStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
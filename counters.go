@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Counter is a named sequence stored in the "counters" collection
+type Counter struct {
+	ID  string `bson:"_id" json:"id"`
+	Seq int64  `bson:"seq" json:"seq"`
+}
+
+// nextSequence atomically increments the named counter and returns the new value.
+// Values are never handed out twice, even if the document they were used for is deleted.
+func nextSequence(client *mongo.Client, name string) (int64, error) {
+	collection := client.Database(Database).Collection("counters")
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter Counter
+	err := collection.FindOneAndUpdate(context.Background(), bson.M{"_id": name}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
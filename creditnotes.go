@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CreditNote struct {
+	Number            string             `json:"number"`
+	InvoiceID         primitive.ObjectID `bson:"invoiceId" json:"invoiceId"`
+	InvoiceNumber     string             `bson:"invoicenumber" json:"invoiceNumber"`
+	CustomerID        primitive.ObjectID `bson:"custId" json:"custId"`
+	Amount            float64            `json:"amount"`
+	Reason            string             `json:"reason"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type CreditNoteGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Number            string             `json:"number"`
+	InvoiceID         primitive.ObjectID `bson:"invoiceId" json:"invoiceId"`
+	InvoiceNumber     string             `bson:"invoicenumber" json:"invoiceNumber"`
+	CustomerID        primitive.ObjectID `bson:"custId" json:"custId"`
+	Amount            float64            `json:"amount"`
+	Reason            string             `json:"reason"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type CreditNoteRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// addCreditNote issues a credit note against an invoice. It lowers what is owed on the invoice
+// and the customer balance without editing the invoice lines or total.
+func addCreditNote(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req CreditNoteRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var invoice InvoiceGet
+		err = client.Database(Database).Collection("invoices").FindOne(context.Background(), bson.M{"_id": oid}).Decode(&invoice)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, ErrInvoiceNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if invoice.Status == InvoiceDraft || invoice.Status == InvoiceVoid {
+			http.Error(w, "credit notes cannot be issued against a "+invoice.Status+" invoice", http.StatusConflict)
+			return
+		}
+		amount := roundMoney(req.Amount)
+		if amount <= 0 || amount > invoiceDue(invoice) {
+			http.Error(w, fmt.Sprintf("credit note must be between 0 and the %.2f outstanding", invoiceDue(invoice)), http.StatusConflict)
+			return
+		}
+
+		seq, err := nextSequence(client, "creditnote")
+		if err != nil {
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		item := CreditNote{
+			Number:            fmt.Sprintf("CN-%06d", seq),
+			InvoiceID:         oid,
+			InvoiceNumber:     invoice.Number,
+			CustomerID:        invoice.CustomerID,
+			Amount:            amount,
+			Reason:            req.Reason,
+			Actor:             requestActor(r),
+			CapturedTimestamp: time.Now(),
+		}
+		_, err = client.Database(Database).Collection("creditnotes").InsertOne(context.Background(), item)
+		if err != nil {
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = postInvoiceAmount(client, id, "credited", amount, "credit_note", item.Number, item.Actor)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = adjustBalance(client, invoice.CustomerID, -amount)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getCreditNotes lists credit notes, optionally for one invoice, as JSON or CSV (?format=csv)
+func getCreditNotes(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := bson.M{}
+		if invoiceID := r.URL.Query().Get("invoiceId"); invoiceID != "" {
+			oid, err := primitive.ObjectIDFromHex(invoiceID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter["invoiceId"] = oid
+		}
+
+		collection := client.Database(Database).Collection("creditnotes")
+		findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+		cursor, err := collection.Find(context.Background(), filter, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []CreditNoteGet
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "csv" {
+			var rows [][]string
+			for _, item := range items {
+				rows = append(rows, []string{item.Number, item.CapturedTimestamp.Format(time.RFC3339), item.InvoiceNumber, item.InvoiceID.Hex(), item.CustomerID.Hex(), formatMoney(item.Amount), item.Reason, item.Actor})
+			}
+			writeCSV(w, "creditnotes.csv", []string{"number", "date", "invoiceNumber", "invoiceId", "custId", "amount", "reason", "actor"}, rows)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var ErrInvalidPage = errors.New("page and limit must be positive numbers")
+
+// pageOptions reads ?page= (from 1) and ?limit= and returns find options for that page, newest first
+func pageOptions(r *http.Request) (*options.FindOptions, error) {
+	page, limit := int64(1), int64(defaultPageSize)
+	var err error
+	if value := r.URL.Query().Get("page"); value != "" {
+		page, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || page < 1 {
+			return nil, ErrInvalidPage
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 {
+			return nil, ErrInvalidPage
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).SetSkip((page - 1) * limit).SetLimit(limit), nil
+}
+
+// writePage sends one page of results with the total number of matches in X-Total-Count
+func writePage(w http.ResponseWriter, collection *mongo.Collection, filter bson.M, findOptions *options.FindOptions, items interface{}) {
+	total, err := collection.CountDocuments(context.Background(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cursor, err := collection.Find(context.Background(), filter, findOptions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = cursor.All(context.Background(), items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	err = json.NewEncoder(w).Encode(items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// getCustomerInvoices lists one customer's invoices a page at a time, optionally by ?status=
+func getCustomerInvoices(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		findOptions, err := pageOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := notDeleted(r, bson.M{"custId": oid})
+		if status := r.URL.Query().Get("status"); status != "" {
+			filter["status"] = status
+		}
+		items := []InvoiceGet{}
+		writePage(w, client.Database(Database).Collection("invoices"), filter, findOptions, &items)
+	}
+}
+
+// getCustomerPayments lists one customer's payments a page at a time
+func getCustomerPayments(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		findOptions, err := pageOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		items := []PaymentCaptureGet{}
+		writePage(w, client.Database(Database).Collection("payments"), notDeleted(r, bson.M{"customerid": oid.Hex()}), findOptions, &items)
+	}
+}
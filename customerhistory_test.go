@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPageOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		skip  int64
+		limit int64
+		err   error
+	}{
+		{name: "defaults", query: "", skip: 0, limit: defaultPageSize},
+		{name: "third page", query: "?page=3&limit=20", skip: 40, limit: 20},
+		{name: "limit capped", query: "?page=2&limit=1000", skip: maxPageSize, limit: maxPageSize},
+		{name: "page zero", query: "?page=0", err: ErrInvalidPage},
+		{name: "negative limit", query: "?limit=-5", err: ErrInvalidPage},
+		{name: "page not a number", query: "?page=last", err: ErrInvalidPage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/customer/1/invoices"+tt.query, nil)
+			got, err := pageOptions(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("pageOptions() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if *got.Skip != tt.skip || *got.Limit != tt.limit {
+				t.Errorf("skip, limit = %d, %d; want %d, %d", *got.Skip, *got.Limit, tt.skip, tt.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DeleteCascade = "cascade"
+	DeleteArchive = "archive"
+)
+
+// DeleteConflict is returned with a 409 when a record still has others depending on it
+type DeleteConflict struct {
+	Error      string           `json:"error"`
+	Dependents map[string]int64 `json:"dependents"`
+	Balance    float64          `json:"balance,omitempty"`
+}
+
+// isAdmin reports whether the request carries the ADMIN_TOKEN in its X-Admin-Token header. The
+// X-Actor header is only for recording who did what, since any client can set it.
+func isAdmin(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) == 1
+}
+
+// countDependents counts the documents matching each filter, leaving out collections with none
+func countDependents(client *mongo.Client, filters map[string]bson.M) (map[string]int64, error) {
+	dependents := map[string]int64{}
+	for collection, filter := range filters {
+		count, err := client.Database(Database).Collection(collection).CountDocuments(context.Background(), filter)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			dependents[collection] = count
+		}
+	}
+	return dependents, nil
+}
+
+// archivedItem returns the name of the first archived item among invoice lines, or "" when none
+// are. Archived items stay on the invoices they are already on but cannot be sold again.
+func archivedItem(client *mongo.Client, lines []ItemGetInv) (string, error) {
+	var ids []primitive.ObjectID
+	for _, line := range lines {
+		if !line.ID.IsZero() {
+			ids = append(ids, line.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	var item ItemGet
+	err := client.Database(Database).Collection("products").FindOne(context.Background(), bson.M{"_id": bson.M{"$in": ids}, "archivedAt": bson.M{"$exists": true}}).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return item.Name, nil
+}
+
+// returnInvoiceStock puts back the stock taken by the issued invoices among those a cascade
+// removed, as voiding them would have
+func returnInvoiceStock(ctx mongo.SessionContext, db *mongo.Database, filter bson.M, actor string) error {
+	cursor, err := db.Collection("invoices").Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var invoices []InvoiceGet
+	err = cursor.All(ctx, &invoices)
+	if err != nil {
+		return err
+	}
+	for _, invoice := range invoices {
+		if invoice.Status == InvoiceDraft || invoice.Status == InvoiceVoid {
+			continue
+		}
+		err := moveStockWith(ctx, db, stockDeltas(invoice.Items, nil), "invoice_deleted", invoice.ID.Hex(), actor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMany removes the documents matching each filter and then the record itself, in one
+// transaction. before, when set, runs first inside the same transaction. Transactions need
+// MongoDB to run as a replica set (a single-node one is enough); a standalone server rejects them.
+func deleteMany(client *mongo.Client, filters map[string]bson.M, collection string, oid primitive.ObjectID, before func(mongo.SessionContext) error) error {
+	db := client.Database(Database)
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(context.Background(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		if before != nil {
+			err := before(sessCtx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for name, filter := range filters {
+			_, err := db.Collection(name).DeleteMany(sessCtx, filter)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err := db.Collection(collection).DeleteOne(sessCtx, bson.M{"_id": oid})
+		return nil, err
+	})
+	return err
+}
+
+// guardedDelete moves a record to the trash unless it has dependents or, for customers, a
+// balance. Admins can pass ?mode=archive to keep the record with archivedAt set, or
+// ?mode=cascade to permanently delete it and the cascade collections' matching documents. Issued
+// invoices removed by a cascade give their stock back.
+func guardedDelete(w http.ResponseWriter, r *http.Request, client *mongo.Client, collection string, oid primitive.ObjectID, balance float64, blockers, cascade map[string]bson.M) {
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+	case DeleteArchive, DeleteCascade:
+		if !isAdmin(r) {
+			http.Error(w, "only admins can delete with mode "+mode, http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "mode must be archive or cascade", http.StatusBadRequest)
+		return
+	}
+
+	if mode == DeleteArchive {
+		// Kept apart from status, which enabling and disabling change
+		update := bumpVersion(bson.M{"$set": bson.M{"archivedAt": time.Now(), "archivedBy": requestActor(r)}})
+		result, err := client.Database(Database).Collection(collection).UpdateOne(context.Background(), notDeleted(nil, bson.M{"_id": oid}), update)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result.MatchedCount == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if mode == DeleteCascade {
+		// The stock comes back in the same transaction as the delete, so neither happens alone
+		var before func(mongo.SessionContext) error
+		if filter, ok := cascade["invoices"]; ok {
+			actor := requestActor(r)
+			before = func(sessCtx mongo.SessionContext) error {
+				return returnInvoiceStock(sessCtx, client.Database(Database), filter, actor)
+			}
+		}
+		err := deleteMany(client, cascade, collection, oid, before)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updateSearchIndex(client, collection, oid)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	dependents, err := countDependents(client, blockers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(dependents) > 0 || roundMoney(balance) != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(DeleteConflict{
+			Error:      "still in use; archive it instead, or have an admin delete it with mode=cascade",
+			Dependents: dependents,
+			Balance:    roundMoney(balance),
+		})
+		return
+	}
+
+	deleted, err := softDelete(client, collection, bson.M{"_id": oid}, requestActor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	updateSearchIndex(client, collection, oid)
+	w.WriteHeader(http.StatusOK)
+}
+
+// customerDependents lists what refers to a customer. Anything on their account blocks a delete;
+// cascade also removes their agreed prices. Payments, receipts and refunds hold the id as a hex
+// string.
+func customerDependents(oid primitive.ObjectID) (blockers, cascade map[string]bson.M) {
+	blockers = map[string]bson.M{
+		"invoices":    {"custId": oid},
+		"payments":    {"customerid": oid.Hex()},
+		"receipts":    {"customerid": oid.Hex()},
+		"refunds":     {"customerid": oid.Hex()},
+		"creditnotes": {"custId": oid},
+		"adjustments": {"custId": oid},
+	}
+	cascade = map[string]bson.M{"customerprices": {"custId": oid}}
+	for name, filter := range blockers {
+		cascade[name] = filter
+	}
+	return blockers, cascade
+}
+
+// itemDependents lists what refers to an item. Only invoices block a delete; an item's own price
+// history, agreed prices and stock movements go with it on cascade, and invoices keep their copy
+// of the line.
+func itemDependents(oid primitive.ObjectID) (blockers, cascade map[string]bson.M) {
+	blockers = map[string]bson.M{"invoices": {"items._id": oid}}
+	cascade = map[string]bson.M{
+		"prices":         {"itemId": oid},
+		"customerprices": {"itemId": oid},
+		"stockmovements": {"itemId": oid},
+	}
+	return blockers, cascade
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		sent  string
+		want  bool
+	}{
+		{name: "matching token", token: "s3cret", sent: "s3cret", want: true},
+		{name: "wrong token", token: "s3cret", sent: "guess", want: false},
+		{name: "no token sent", token: "s3cret", sent: "", want: false},
+		{name: "no token configured", token: "", sent: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", tt.token)
+			r := httptest.NewRequest(http.MethodDelete, "/customer/1?mode=cascade", nil)
+			// Naming yourself as an admin is not enough
+			r.Header.Set("X-Actor", "admin")
+			if tt.sent != "" {
+				r.Header.Set("X-Admin-Token", tt.sent)
+			}
+			if got := isAdmin(r); got != tt.want {
+				t.Errorf("isAdmin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomerDependents(t *testing.T) {
+	oid := primitive.NewObjectID()
+	blockers, cascade := customerDependents(oid)
+
+	// Payments, receipts and refunds store the customer as a hex string
+	for _, name := range []string{"payments", "receipts", "refunds"} {
+		if !reflect.DeepEqual(blockers[name], bson.M{"customerid": oid.Hex()}) {
+			t.Errorf("blockers[%s] = %v, want customerid %s", name, blockers[name], oid.Hex())
+		}
+	}
+	for _, name := range []string{"invoices", "creditnotes", "adjustments"} {
+		if !reflect.DeepEqual(blockers[name], bson.M{"custId": oid}) {
+			t.Errorf("blockers[%s] = %v, want custId %s", name, blockers[name], oid.Hex())
+		}
+	}
+	for name, filter := range blockers {
+		if !reflect.DeepEqual(cascade[name], filter) {
+			t.Errorf("cascade does not remove the %s that block a delete", name)
+		}
+	}
+	if _, ok := blockers["customerprices"]; ok {
+		t.Error("agreed prices should not block a delete")
+	}
+	if !reflect.DeepEqual(cascade["customerprices"], bson.M{"custId": oid}) {
+		t.Errorf("cascade[customerprices] = %v", cascade["customerprices"])
+	}
+}
+
+func TestItemDependents(t *testing.T) {
+	oid := primitive.NewObjectID()
+	blockers, cascade := itemDependents(oid)
+
+	wantBlockers := map[string]bson.M{"invoices": {"items._id": oid}}
+	if !reflect.DeepEqual(blockers, wantBlockers) {
+		t.Errorf("blockers = %v, want %v", blockers, wantBlockers)
+	}
+	if _, ok := cascade["invoices"]; ok {
+		t.Error("cascade should leave invoices, which keep their copy of the line")
+	}
+	for _, name := range []string{"prices", "customerprices", "stockmovements"} {
+		if !reflect.DeepEqual(cascade[name], bson.M{"itemId": oid}) {
+			t.Errorf("cascade[%s] = %v, want itemId %s", name, cascade[name], oid.Hex())
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Discount takes either a percentage ("percent") or a fixed amount ("fixed") off a line or invoice
+type Discount struct {
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+}
+
+type Coupon struct {
+	Code              string    `json:"code"`
+	Discount          Discount  `json:"discount"`
+	ValidFrom         time.Time `bson:"validfrom" json:"validFrom"`
+	ValidTo           time.Time `bson:"validto" json:"validTo"`
+	MaxUses           int64     `bson:"maxuses" json:"maxUses"`
+	Uses              int64     `json:"uses"`
+	Status            string    `json:"status"`
+	CapturedTimestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+type CouponGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Code              string             `json:"code"`
+	Discount          Discount           `json:"discount"`
+	ValidFrom         time.Time          `bson:"validfrom" json:"validFrom"`
+	ValidTo           time.Time          `bson:"validto" json:"validTo"`
+	MaxUses           int64              `bson:"maxuses" json:"maxUses"`
+	Uses              int64              `json:"uses"`
+	Status            string             `json:"status"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// CustomerPrice is a price agreed with one customer that replaces the catalog price on their invoices
+type CustomerPrice struct {
+	CustomerID        primitive.ObjectID `bson:"custId" json:"custId"`
+	ItemID            primitive.ObjectID `bson:"itemId" json:"itemId"`
+	VariantSKU        string             `bson:"variantSku,omitempty" json:"variantSku,omitempty"`
+	Price             float64            `json:"price"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+var ErrInvalidDiscount = errors.New("invalid discount")
+var ErrInvalidCoupon = errors.New("invalid coupon")
+
+// validateDiscount checks a discount is a known type with a sensible value; nil means no discount
+func validateDiscount(d *Discount) error {
+	if d == nil {
+		return nil
+	}
+	switch {
+	case d.Type != "percent" && d.Type != "fixed":
+		return fmt.Errorf("%w: type must be percent or fixed", ErrInvalidDiscount)
+	case d.Value < 0:
+		return fmt.Errorf("%w: value must not be negative", ErrInvalidDiscount)
+	case d.Type == "percent" && d.Value > 100:
+		return fmt.Errorf("%w: percentage cannot be more than 100", ErrInvalidDiscount)
+	}
+	return nil
+}
+
+// discountAmount works out how much a discount takes off an amount, never more than the amount itself
+func discountAmount(d *Discount, amount float64) float64 {
+	if d == nil || amount <= 0 {
+		return 0
+	}
+	off := d.Value
+	if d.Type == "percent" {
+		off = amount * d.Value / 100
+	}
+	return roundMoney(math.Min(off, amount))
+}
+
+// discountInvoiceLines applies each line's own discount and then spreads the invoice-level
+// discounts over the lines in proportion to what is left on them, so that tax is charged on the
+// discounted amounts. Invoice discounts apply one after the other.
+func discountInvoiceLines(lines []ItemGetInv, invoiceDiscounts ...*Discount) error {
+	var remaining float64
+	for i := range lines {
+		err := validateDiscount(lines[i].Discount)
+		if err != nil {
+			return err
+		}
+		lines[i].DiscountAmount = discountAmount(lines[i].Discount, roundMoney(lines[i].Price*float64(lines[i].Qty)))
+		remaining += roundMoney(lines[i].Price*float64(lines[i].Qty)) - lines[i].DiscountAmount
+	}
+
+	for _, d := range invoiceDiscounts {
+		err := validateDiscount(d)
+		if err != nil {
+			return err
+		}
+		off := discountAmount(d, roundMoney(remaining))
+		if off == 0 {
+			continue
+		}
+		// Spread by share of the remaining amount; the last line takes the rounding difference
+		left := off
+		last := -1
+		for i := range lines {
+			if roundMoney(lines[i].Price*float64(lines[i].Qty))-lines[i].DiscountAmount > 0 {
+				last = i
+			}
+		}
+		for i := range lines {
+			lineAmount := roundMoney(lines[i].Price*float64(lines[i].Qty)) - lines[i].DiscountAmount
+			if lineAmount <= 0 {
+				continue
+			}
+			share := roundMoney(off * lineAmount / remaining)
+			if i == last {
+				share = roundMoney(math.Min(left, lineAmount))
+			}
+			lines[i].DiscountAmount = roundMoney(lines[i].DiscountAmount + share)
+			left = roundMoney(left - share)
+		}
+		remaining = roundMoney(remaining - off)
+	}
+	return nil
+}
+
+// customerPrices loads the prices agreed with a customer, keyed by item and variant
+func customerPrices(client *mongo.Client, custID primitive.ObjectID) (map[StockKey]float64, error) {
+	prices := map[StockKey]float64{}
+	if custID.IsZero() {
+		return prices, nil
+	}
+	cursor, err := client.Database(Database).Collection("customerprices").Find(context.Background(), bson.M{"custId": custID})
+	if err != nil {
+		return nil, err
+	}
+	var items []CustomerPrice
+	err = cursor.All(context.Background(), &items)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		prices[StockKey{ItemID: item.ItemID, VariantSKU: item.VariantSKU}] = item.Price
+	}
+	return prices, nil
+}
+
+// redeemCoupon checks a coupon is active, inside its validity window and under its usage limit and
+// counts one use of it. The check and the count are a single update so a coupon cannot be used
+// more times than allowed.
+func redeemCoupon(client *mongo.Client, code string, now time.Time) (CouponGet, error) {
+	var coupon CouponGet
+	code = strings.ToUpper(strings.TrimSpace(code))
+	filter := bson.M{
+		"code":      code,
+		"status":    bson.M{"$ne": "disabled"},
+		"validfrom": bson.M{"$lte": now},
+		"$and": bson.A{
+			bson.M{"$or": bson.A{bson.M{"validto": bson.M{"$gte": now}}, bson.M{"validto": time.Time{}}}},
+			bson.M{"$or": bson.A{bson.M{"maxuses": 0}, bson.M{"$expr": bson.M{"$lt": bson.A{"$uses", "$maxuses"}}}}},
+		},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	collection := client.Database(Database).Collection("coupons")
+	err := collection.FindOneAndUpdate(context.Background(), filter, bson.M{"$inc": bson.M{"uses": 1}}, opts).Decode(&coupon)
+	if err != mongo.ErrNoDocuments {
+		return coupon, err
+	}
+
+	// Say why the coupon was refused
+	err = collection.FindOne(context.Background(), bson.M{"code": code}).Decode(&coupon)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return coupon, fmt.Errorf("%w: %s does not exist", ErrInvalidCoupon, code)
+	case err != nil:
+		return coupon, err
+	case coupon.Status == "disabled":
+		return coupon, fmt.Errorf("%w: %s is disabled", ErrInvalidCoupon, code)
+	case coupon.MaxUses > 0 && coupon.Uses >= coupon.MaxUses:
+		return coupon, fmt.Errorf("%w: %s has been used the maximum number of times", ErrInvalidCoupon, code)
+	}
+	return coupon, fmt.Errorf("%w: %s is not valid on %s", ErrInvalidCoupon, code, now.Format("2006-01-02"))
+}
+
+// releaseCoupon gives back a use of a coupon when the invoice it was redeemed for was not saved
+func releaseCoupon(client *mongo.Client, code string) {
+	_, err := client.Database(Database).Collection("coupons").UpdateOne(context.Background(), bson.M{"code": code, "uses": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"uses": -1}})
+	if err != nil {
+		log.Println("coupon", code+":", err.Error())
+	}
+}
+
+// invoiceErrorStatus maps errors from calculating an invoice to HTTP statuses
+func invoiceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrItemNotFound), errors.Is(err, ErrVariantNotFound), errors.Is(err, ErrInvalidDiscount):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInvalidCoupon):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// addCoupon creates a reusable coupon code
+func addCoupon(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var item Coupon
+		err := json.NewDecoder(r.Body).Decode(&item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		item.Code = strings.ToUpper(strings.TrimSpace(item.Code))
+		if item.Code == "" {
+			http.Error(w, "code is required", http.StatusBadRequest)
+			return
+		}
+		err = validateDiscount(&item.Discount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !item.ValidTo.IsZero() && item.ValidTo.Before(item.ValidFrom) {
+			http.Error(w, "validTo must be after validFrom", http.StatusBadRequest)
+			return
+		}
+
+		item.Uses = 0
+		item.Status = "active"
+		item.CapturedTimestamp = time.Now()
+		if item.ValidFrom.IsZero() {
+			item.ValidFrom = item.CapturedTimestamp
+		}
+		_, err = client.Database(Database).Collection("coupons").InsertOne(context.Background(), item)
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "a coupon with this code already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// getCoupons lists all coupons with how often they have been used
+func getCoupons(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := client.Database(Database).Collection("coupons")
+		findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+		cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []CouponGet
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// disableCoupon stops a coupon from being redeemed; invoices that already used it keep their discount
+func disableCoupon(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		code := strings.ToUpper(vars["code"])
+
+		collection := client.Database(Database).Collection("coupons")
+		result, err := collection.UpdateOne(context.Background(), bson.M{"code": code}, bson.M{"$set": bson.M{"status": "disabled"}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result.MatchedCount == 0 {
+			http.Error(w, "coupon not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// setCustomerPrice agrees a price for an item or variant with a customer, replacing any earlier one
+func setCustomerPrice(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		custOid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var item CustomerPrice
+		err = json.NewDecoder(r.Body).Decode(&item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if item.Price < 0 {
+			http.Error(w, "price must not be negative", http.StatusBadRequest)
+			return
+		}
+		customerFilter := notDeleted(nil, bson.M{"_id": custOid, "archivedAt": bson.M{"$exists": false}})
+		count, err := client.Database(Database).Collection("customer").CountDocuments(context.Background(), customerFilter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count == 0 {
+			http.Error(w, "customer not found", http.StatusNotFound)
+			return
+		}
+		itemFilter := bson.M{"_id": item.ItemID}
+		if item.VariantSKU != "" {
+			itemFilter["variants.sku"] = item.VariantSKU
+		}
+		count, err = client.Database(Database).Collection("products").CountDocuments(context.Background(), itemFilter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count == 0 {
+			http.Error(w, "item or variant not found", http.StatusBadRequest)
+			return
+		}
+
+		item.CustomerID = custOid
+		item.Price = roundMoney(item.Price)
+		item.Actor = requestActor(r)
+		item.CapturedTimestamp = time.Now()
+		filter := bson.M{"custId": custOid, "itemId": item.ItemID, "variantSku": item.VariantSKU}
+		if item.VariantSKU == "" {
+			filter["variantSku"] = bson.M{"$exists": false}
+		}
+		opts := options.Replace().SetUpsert(true)
+		_, err = client.Database(Database).Collection("customerprices").ReplaceOne(context.Background(), filter, item, opts)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// getCustomerPrices lists the prices agreed with a customer
+func getCustomerPrices(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		custOid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cursor, err := client.Database(Database).Collection("customerprices").Find(context.Background(), bson.M{"custId": custOid})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []CustomerPrice
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// deleteCustomerPrice removes an agreed price so the customer pays the catalog price again.
+// ?variantSku= selects a variant's price.
+func deleteCustomerPrice(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		custOid, err := primitive.ObjectIDFromHex(vars["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		itemOid, err := primitive.ObjectIDFromHex(vars["itemId"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{"custId": custOid, "itemId": itemOid, "variantSku": bson.M{"$exists": false}}
+		if sku := r.URL.Query().Get("variantSku"); sku != "" {
+			filter["variantSku"] = sku
+		}
+		_, err = client.Database(Database).Collection("customerprices").DeleteOne(context.Background(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
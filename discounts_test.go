@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestDiscountInvoiceLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     []ItemGetInv
+		discounts []*Discount
+		want      []float64
+		err       error
+	}{
+		{
+			name:      "fixed discount larger than one line",
+			lines:     []ItemGetInv{{Price: 20, Qty: 1}, {Price: 30, Qty: 1}},
+			discounts: []*Discount{{Type: "fixed", Value: 40}},
+			want:      []float64{16, 24},
+		},
+		{
+			name:      "rounding remainder on the last line",
+			lines:     []ItemGetInv{{Price: 10, Qty: 1}, {Price: 10, Qty: 1}, {Price: 10, Qty: 1}},
+			discounts: []*Discount{{Type: "fixed", Value: 10}},
+			want:      []float64{3.33, 3.33, 3.34},
+		},
+		{
+			name:      "100% discount",
+			lines:     []ItemGetInv{{Price: 12.34, Qty: 2}, {Price: 5, Qty: 1}},
+			discounts: []*Discount{{Type: "percent", Value: 100}},
+			want:      []float64{24.68, 5},
+		},
+		{
+			name:      "fixed discount larger than the invoice",
+			lines:     []ItemGetInv{{Price: 10, Qty: 1}, {Price: 15, Qty: 1}},
+			discounts: []*Discount{{Type: "fixed", Value: 100}},
+			want:      []float64{10, 15},
+		},
+		{
+			name:      "line discount then invoice discount",
+			lines:     []ItemGetInv{{Price: 50, Qty: 2, Discount: &Discount{Type: "percent", Value: 10}}, {Price: 100, Qty: 1}},
+			discounts: []*Discount{{Type: "percent", Value: 10}},
+			want:      []float64{19, 10},
+		},
+		{
+			name:  "line discount capped at the line",
+			lines: []ItemGetInv{{Price: 5, Qty: 1, Discount: &Discount{Type: "fixed", Value: 8}}},
+			want:  []float64{5},
+		},
+		{
+			name:      "fully discounted line takes no invoice discount",
+			lines:     []ItemGetInv{{Price: 5, Qty: 1, Discount: &Discount{Type: "percent", Value: 100}}, {Price: 20, Qty: 1}},
+			discounts: []*Discount{{Type: "fixed", Value: 4}},
+			want:      []float64{5, 4},
+		},
+		{
+			name:      "percentage over 100",
+			lines:     []ItemGetInv{{Price: 10, Qty: 1}},
+			discounts: []*Discount{{Type: "percent", Value: 120}},
+			err:       ErrInvalidDiscount,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := discountInvoiceLines(tt.lines, tt.discounts...)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("discountInvoiceLines() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			for i, want := range tt.want {
+				if got := tt.lines[i].DiscountAmount; got != want {
+					t.Errorf("line %d discount = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		discount *Discount
+		wantErr  bool
+	}{
+		{name: "none", discount: nil},
+		{name: "percent", discount: &Discount{Type: "percent", Value: 15}},
+		{name: "fixed", discount: &Discount{Type: "fixed", Value: 250}},
+		{name: "unknown type", discount: &Discount{Type: "bogo", Value: 1}, wantErr: true},
+		{name: "negative", discount: &Discount{Type: "fixed", Value: -5}, wantErr: true},
+		{name: "percent over 100", discount: &Discount{Type: "percent", Value: 101}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDiscount(tt.discount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateDiscount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidDiscount) {
+				t.Errorf("validateDiscount() error = %v, want ErrInvalidDiscount", err)
+			}
+		})
+	}
+}
+
+func TestDiscountAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		discount *Discount
+		amount   float64
+		want     float64
+	}{
+		{name: "none", discount: nil, amount: 100, want: 0},
+		{name: "percent", discount: &Discount{Type: "percent", Value: 12.5}, amount: 80, want: 10},
+		{name: "percent rounded", discount: &Discount{Type: "percent", Value: 10}, amount: 33.33, want: 3.33},
+		{name: "fixed", discount: &Discount{Type: "fixed", Value: 7}, amount: 20, want: 7},
+		{name: "fixed capped at the amount", discount: &Discount{Type: "fixed", Value: 30}, amount: 20, want: 20},
+		{name: "nothing to discount", discount: &Discount{Type: "fixed", Value: 5}, amount: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := discountAmount(tt.discount, tt.amount); got != tt.want {
+				t.Errorf("discountAmount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvoiceErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "unknown item", err: ErrItemNotFound, want: http.StatusBadRequest},
+		{name: "unknown variant", err: fmt.Errorf("%w: Pen has no variant PEN-GRN", ErrVariantNotFound), want: http.StatusBadRequest},
+		{name: "invalid discount", err: fmt.Errorf("%w: value must not be negative", ErrInvalidDiscount), want: http.StatusBadRequest},
+		{name: "coupon used up", err: fmt.Errorf("%w: SUMMER has been used up", ErrInvalidCoupon), want: http.StatusConflict},
+		{name: "anything else", err: errors.New("connection reset"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := invoiceErrorStatus(tt.err); got != tt.want {
+				t.Errorf("invoiceErrorStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
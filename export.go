@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+)
+
+// formatMoney renders an amount the way it is shown in exports
+func formatMoney(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// writeCSV sends rows as a CSV attachment with the given header line
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	writer.WriteAll(rows)
+}
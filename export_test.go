@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   string
+	}{
+		{amount: 0, want: "0.00"},
+		{amount: 12.5, want: "12.50"},
+		{amount: 1234.567, want: "1234.57"},
+		{amount: -3.1, want: "-3.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatMoney(tt.amount); got != tt.want {
+				t.Errorf("formatMoney(%v) = %q, want %q", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeCSV(w, "refunds.csv", []string{"number", "reason"}, [][]string{{"RF-000001", "damaged, returned"}})
+
+	if got := w.Header().Get("Content-Type"); got != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="refunds.csv"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	want := "number,reason\nRF-000001,\"damaged, returned\"\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+// fakestripe is a small stand-in for the Stripe API used when developing or testing payments locally.
+// Point the backend at it with STRIPE_API_URL=http://localhost:12111 and give both the same
+// STRIPE_WEBHOOK_SECRET. Paying a PaymentIntent or Checkout session through
+// POST /pay/{id} sends a signed payment_intent.succeeded event to WEBHOOK_URL.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PaymentIntent struct {
+	ID             string            `json:"id"`
+	Object         string            `json:"object"`
+	ClientSecret   string            `json:"client_secret"`
+	Amount         int64             `json:"amount"`
+	AmountReceived int64             `json:"amount_received"`
+	Currency       string            `json:"currency"`
+	Status         string            `json:"status"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+type server struct {
+	mu         sync.Mutex
+	seq        int
+	intents    map[string]*PaymentIntent
+	sessions   map[string]string
+	webhookURL string
+	secret     string
+}
+
+func getEnvDefault(name, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func main() {
+	s := &server{
+		intents:    map[string]*PaymentIntent{},
+		sessions:   map[string]string{},
+		webhookURL: getEnvDefault("WEBHOOK_URL", "http://localhost:8003/webhooks/stripe"),
+		secret:     os.Getenv("STRIPE_WEBHOOK_SECRET"),
+	}
+	addr := getEnvDefault("FAKE_STRIPE_ADDR", ":12111")
+
+	http.HandleFunc("/v1/payment_intents", s.createPaymentIntent)
+	http.HandleFunc("/v1/checkout/sessions", s.createCheckoutSession)
+	http.HandleFunc("/v1/refunds", s.createRefund)
+	http.HandleFunc("/pay/", s.pay)
+
+	log.Println("Fake Stripe listening on", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+// metadata collects form fields such as metadata[invoiceId] under the given prefix
+func metadata(r *http.Request, prefix string) map[string]string {
+	out := map[string]string{}
+	for key, values := range r.PostForm {
+		if strings.HasPrefix(key, prefix+"[") && strings.HasSuffix(key, "]") {
+			out[key[len(prefix)+1:len(key)-1]] = values[0]
+		}
+	}
+	return out
+}
+
+func (s *server) newIntent(amount int64, currency string, meta map[string]string) *PaymentIntent {
+	s.seq++
+	id := fmt.Sprintf("pi_fake_%d", s.seq)
+	intent := &PaymentIntent{
+		ID:           id,
+		Object:       "payment_intent",
+		ClientSecret: id + "_secret",
+		Amount:       amount,
+		Currency:     currency,
+		Status:       "requires_payment_method",
+		Metadata:     meta,
+	}
+	s.intents[id] = intent
+	return intent
+}
+
+func (s *server) createPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+
+	s.mu.Lock()
+	intent := s.newIntent(amount, r.PostForm.Get("currency"), metadata(r, "metadata"))
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(intent)
+}
+
+func (s *server) createCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	amount, _ := strconv.ParseInt(r.PostForm.Get("line_items[0][price_data][unit_amount]"), 10, 64)
+
+	s.mu.Lock()
+	intent := s.newIntent(amount, r.PostForm.Get("line_items[0][price_data][currency]"), metadata(r, "payment_intent_data[metadata]"))
+	sessionID := fmt.Sprintf("cs_fake_%d", s.seq)
+	s.sessions[sessionID] = intent.ID
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":  sessionID,
+		"url": "http://localhost" + getEnvDefault("FAKE_STRIPE_ADDR", ":12111") + "/pay/" + sessionID,
+	})
+}
+
+func (s *server) createRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+
+	s.mu.Lock()
+	_, ok := s.intents[r.PostForm.Get("payment_intent")]
+	s.seq++
+	id := fmt.Sprintf("re_fake_%d", s.seq)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"error":{"message":"No such payment_intent"}}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "object": "refund", "amount": amount, "status": "succeeded"})
+}
+
+// pay marks a PaymentIntent (or the one behind a Checkout session) as succeeded and delivers the webhook.
+// Calling it twice redelivers the same event, which exercises the backend's idempotency.
+func (s *server) pay(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/pay/")
+
+	s.mu.Lock()
+	if intentID, ok := s.sessions[id]; ok {
+		id = intentID
+	}
+	intent, ok := s.intents[id]
+	if ok {
+		intent.Status = "succeeded"
+		intent.AmountReceived = intent.Amount
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such payment intent", http.StatusNotFound)
+		return
+	}
+
+	event := map[string]interface{}{
+		"id":   "evt_" + intent.ID,
+		"type": "payment_intent.succeeded",
+		"data": map[string]interface{}{"object": intent},
+	}
+	payload, _ := json.Marshal(event)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	signature := "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequest("POST", s.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signature)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.Body.Close()
+
+	log.Println("delivered", event["id"], "->", resp.Status)
+	fmt.Fprintf(w, "webhook delivered: %s\n", resp.Status)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyRecord stores the first response given for an Idempotency-Key
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	Fingerprint string    `bson:"fingerprint"`
+	Status      int       `bson:"status"`
+	ContentType string    `bson:"contenttype"`
+	Body        []byte    `bson:"body"`
+	Done        bool      `bson:"done"`
+	CreatedAt   time.Time `bson:"createdAt"`
+}
+
+// idempotencyRetention is how long keys are remembered, configurable in hours through IDEMPOTENCY_RETENTION_HOURS
+func idempotencyRetention() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_RETENTION_HOURS"))
+	if err != nil || hours <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// ensureIdempotencyIndex lets Mongo expire stored keys once the retention window has passed, as the
+// idempotency-key-expiry migration. An index left from before it was a migration with a different
+// retention is updated in place; to change the retention later, revert and reapply the migration.
+func ensureIdempotencyIndex(client *mongo.Client) error {
+	collection := client.Database(Database).Collection("idempotencykeys")
+	seconds := int32(idempotencyRetention().Seconds())
+	indexModel := mongo.IndexModel{
+		Keys:    bson.M{"createdAt": 1},
+		Options: options.Index().SetName("createdAt_ttl").SetExpireAfterSeconds(seconds),
+	}
+	_, err := collection.Indexes().CreateOne(context.Background(), indexModel)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 85 {
+		command := bson.D{
+			{Key: "collMod", Value: "idempotencykeys"},
+			{Key: "index", Value: bson.M{"name": "createdAt_ttl", "expireAfterSeconds": seconds}},
+		}
+		return client.Database(Database).RunCommand(context.Background(), command).Err()
+	}
+	return err
+}
+
+// responseRecorder captures a handler's response so it can be stored and replayed
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	body    bytes.Buffer
+	release bool
+}
+
+// releaseIdempotencyKey tells idempotent that the handler is failing before it changed anything,
+// so its 5xx response frees the key for a retry instead of being stored
+func releaseIdempotencyKey(w http.ResponseWriter) {
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.release = true
+	}
+}
+
+// unchangedError marks an error from a step that failed before anything was written
+type unchangedError struct {
+	err error
+}
+
+func (e unchangedError) Error() string { return e.err.Error() }
+func (e unchangedError) Unwrap() error { return e.err }
+
+// nothingChanged marks err as happening before anything was written, for releaseIfUnchanged
+func nothingChanged(err error) error {
+	if err == nil {
+		return nil
+	}
+	return unchangedError{err}
+}
+
+// releaseIfUnchanged releases the idempotency key when err was marked with nothingChanged
+func releaseIfUnchanged(w http.ResponseWriter, err error) {
+	var unchanged unchangedError
+	if errors.As(err, &unchanged) {
+		releaseIdempotencyKey(w)
+	}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a money-moving POST handler. When the request carries an Idempotency-Key the
+// first response is stored and repeats of the same request within the retention window get that
+// response replayed instead of running the handler again. Reusing a key for a different request
+// is rejected. A 5xx is stored like any other response, since the handler may already have
+// recorded money or stock; only handlers that call releaseIdempotencyKey before failing free the
+// key for a retry.
+func idempotent(client *mongo.Client, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		collection := client.Database(Database).Collection("idempotencykeys")
+		record := IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now()}
+		_, err = collection.InsertOne(context.Background(), record)
+		if mongo.IsDuplicateKeyError(err) {
+			var previous IdempotencyRecord
+			err = collection.FindOne(context.Background(), bson.M{"_id": key}).Decode(&previous)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			switch {
+			case previous.Fingerprint != fingerprint:
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+			case !previous.Done:
+				http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				if previous.ContentType != "" {
+					w.Header().Set("Content-Type", previous.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(previous.Status)
+				w.Write(previous.Body)
+			}
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		if rec.status >= 500 && rec.release {
+			_, err = collection.DeleteOne(context.Background(), bson.M{"_id": key})
+		} else {
+			update := bson.M{"$set": bson.M{"status": rec.status, "contenttype": w.Header().Get("Content-Type"), "body": rec.body.Bytes(), "done": true}}
+			_, err = collection.UpdateOne(context.Background(), bson.M{"_id": key}, update)
+		}
+		if err != nil {
+			log.Println("idempotency:", key, err.Error())
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyRetention(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "unset", value: "", want: 24 * time.Hour},
+		{name: "hours", value: "72", want: 72 * time.Hour},
+		{name: "zero", value: "0", want: 24 * time.Hour},
+		{name: "negative", value: "-5", want: 24 * time.Hour},
+		{name: "not a number", value: "two days", want: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IDEMPOTENCY_RETENTION_HOURS", tt.value)
+			if got := idempotencyRetention(); got != tt.want {
+				t.Errorf("idempotencyRetention() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		body    string
+	}{
+		{
+			name: "explicit status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":"1"}`))
+			},
+			status: http.StatusCreated, body: `{"id":"1"}`,
+		},
+		{
+			name:    "write without a status",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) },
+			status:  http.StatusOK, body: "ok",
+		},
+		{
+			name:    "error",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "boom", http.StatusInternalServerError) },
+			status:  http.StatusInternalServerError, body: "boom\n",
+		},
+		{
+			name:    "nothing written",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			status:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rec := &responseRecorder{ResponseWriter: w}
+			tt.handler(rec, httptest.NewRequest(http.MethodPost, "/invoices", nil))
+			if rec.status != tt.status {
+				t.Errorf("status = %d, want %d", rec.status, tt.status)
+			}
+			if got := rec.body.String(); got != tt.body {
+				t.Errorf("recorded body = %q, want %q", got, tt.body)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("client got %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestReleaseIdempotencyKey(t *testing.T) {
+	rec := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	if rec.release {
+		t.Fatal("a new recorder should keep its key")
+	}
+	releaseIdempotencyKey(rec)
+	if !rec.release {
+		t.Error("releaseIdempotencyKey() did not mark the recorder")
+	}
+
+	// Handlers also run without the middleware, when no Idempotency-Key was sent
+	releaseIdempotencyKey(httptest.NewRecorder())
+}
+
+func TestReleaseIfUnchanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		release bool
+	}{
+		{name: "failed before writing", err: nothingChanged(ErrPaymentNotFound), release: true},
+		{name: "wrapped after marking", err: fmt.Errorf("refund: %w", nothingChanged(errors.New("timeout"))), release: true},
+		{name: "failed after writing", err: errors.New("timeout"), release: false},
+		{name: "no error", err: nothingChanged(nil), release: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+			releaseIfUnchanged(rec, tt.err)
+			if rec.release != tt.release {
+				t.Errorf("release = %v, want %v", rec.release, tt.release)
+			}
+		})
+	}
+}
+
+func TestNothingChangedKeepsTheError(t *testing.T) {
+	err := nothingChanged(fmt.Errorf("%w: only 5.00 is left to refund", ErrInvalidRefund))
+	if !errors.Is(err, ErrInvalidRefund) {
+		t.Errorf("errors.Is(%v, ErrInvalidRefund) = false", err)
+	}
+	if got, want := err.Error(), "invalid refund: only 5.00 is left to refund"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BillingSnapshot is the customer's name and address as printed on an invoice when it was issued
+type BillingSnapshot struct {
+	Name    string `json:"name"`
+	Careof  string `json:"careof"`
+	Address string `json:"address"`
+}
+
+func billingSnapshot(customer CustomerGet) BillingSnapshot {
+	return BillingSnapshot{Name: customer.Name, Careof: customer.Careof, Address: customer.Address}
+}
+
+// invoiceCustomerID returns the customer an invoice request is for. Older clients send the whole
+// customer object rather than custId.
+func invoiceCustomerID(custID primitive.ObjectID, customer *CustomerGet) primitive.ObjectID {
+	if custID.IsZero() && customer != nil {
+		return customer.ID
+	}
+	return custID
+}
+
+// wantsExpand reports whether ?expand= lists the given field, e.g. ?expand=customer
+func wantsExpand(r *http.Request, field string) bool {
+	for _, value := range strings.Split(r.URL.Query().Get("expand"), ",") {
+		if strings.TrimSpace(value) == field {
+			return true
+		}
+	}
+	return false
+}
+
+// expandCustomers fills in the live customer record of each invoice
+func expandCustomers(client *mongo.Client, invoices []InvoiceGet) error {
+	var ids []primitive.ObjectID
+	for _, invoice := range invoices {
+		ids = append(ids, invoice.CustomerID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	cursor, err := client.Database(Database).Collection("customer").Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var customers []CustomerGet
+	err = cursor.All(context.Background(), &customers)
+	if err != nil {
+		return err
+	}
+	byID := map[primitive.ObjectID]CustomerGet{}
+	for _, customer := range customers {
+		byID[customer.ID] = customer
+	}
+	for i := range invoices {
+		if customer, ok := byID[invoices[i].CustomerID]; ok {
+			invoices[i].Customer = &customer
+		}
+	}
+	return nil
+}
+
+// migrateInvoiceCustomers rewrites invoices that embed a copy of the customer so they hold the
+// customer id and a billing snapshot instead. Already migrated invoices are not matched, so it is
+// safe to run on every start.
+func migrateInvoiceCustomers(client *mongo.Client) (int64, error) {
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"custId": "$customer._id",
+			"billing": bson.M{
+				"name":    bson.M{"$ifNull": bson.A{"$customer.name", ""}},
+				"careof":  bson.M{"$ifNull": bson.A{"$customer.careof", ""}},
+				"address": bson.M{"$ifNull": bson.A{"$customer.address", ""}},
+			},
+		}},
+		bson.M{"$unset": "customer"},
+	}
+	collection := client.Database(Database).Collection("invoices")
+	result, err := collection.UpdateMany(context.Background(), bson.M{"customer": bson.M{"$exists": true}}, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
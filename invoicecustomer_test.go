@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBillingSnapshot(t *testing.T) {
+	customer := CustomerGet{ID: primitive.NewObjectID(), Name: "Asha Traders", Careof: "R. Mehta", Address: "12 Market Road", Balance: 250}
+	want := BillingSnapshot{Name: "Asha Traders", Careof: "R. Mehta", Address: "12 Market Road"}
+	if got := billingSnapshot(customer); got != want {
+		t.Errorf("billingSnapshot() = %+v, want %+v", got, want)
+	}
+}
+
+func TestInvoiceCustomerID(t *testing.T) {
+	sent, embedded := primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name     string
+		custID   primitive.ObjectID
+		customer *CustomerGet
+		want     primitive.ObjectID
+	}{
+		{name: "custId", custID: sent, want: sent},
+		{name: "customer object from an older client", customer: &CustomerGet{ID: embedded}, want: embedded},
+		{name: "custId wins over the customer object", custID: sent, customer: &CustomerGet{ID: embedded}, want: sent},
+		{name: "neither", want: primitive.NilObjectID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := invoiceCustomerID(tt.custID, tt.customer); got != tt.want {
+				t.Errorf("invoiceCustomerID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWantsExpand(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{query: "", want: false},
+		{query: "?expand=customer", want: true},
+		{query: "?expand=payments,%20customer", want: true},
+		{query: "?expand=customers", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/invoices"+tt.query, nil)
+			if got := wantsExpand(r, "customer"); got != tt.want {
+				t.Errorf("wantsExpand(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
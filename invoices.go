@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// invoicePrefix returns the prefix used for invoice numbers, configurable through INVOICE_PREFIX
+func invoicePrefix() string {
+	prefix := os.Getenv("INVOICE_PREFIX")
+	if prefix == "" {
+		return "INV"
+	}
+	return prefix
+}
+
+// nextInvoiceNumber hands out the next number from the per-year invoice counter, e.g. INV-2026-000123
+func nextInvoiceNumber(client *mongo.Client, date time.Time) (string, error) {
+	year := date.Year()
+	seq, err := nextSequence(client, fmt.Sprintf("invoice-%d", year))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%06d", invoicePrefix(), year, seq), nil
+}
+
+// getInvoiceByNumber looks up a single invoice by its human-readable number
+func getInvoiceByNumber(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		number := vars["number"]
+
+		collection := client.Database(Database).Collection("invoices")
+		var invoice InvoiceGet
+		err := collection.FindOne(context.Background(), notDeleted(r, bson.M{"number": number})).Decode(&invoice)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "invoice not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if wantsExpand(r, "customer") {
+			invoices := []InvoiceGet{invoice}
+			err = expandCustomers(client, invoices)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			invoice = invoices[0]
+		}
+
+		setETag(w, invoice.Version)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(invoice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	InvoiceDraft         = "draft"
+	InvoiceIssued        = "issued"
+	InvoicePartiallyPaid = "partially_paid"
+	InvoicePaid          = "paid"
+	InvoiceOverdue       = "overdue"
+	InvoiceVoid          = "void"
+)
+
+// invoiceTransitions lists the statuses each status may move to
+var invoiceTransitions = map[string][]string{
+	InvoiceDraft:         {InvoiceIssued, InvoiceVoid},
+	InvoiceIssued:        {InvoicePartiallyPaid, InvoicePaid, InvoiceOverdue, InvoiceVoid},
+	InvoicePartiallyPaid: {InvoicePaid, InvoiceOverdue, InvoiceVoid},
+	InvoiceOverdue:       {InvoicePartiallyPaid, InvoicePaid, InvoiceVoid},
+	InvoicePaid:          {InvoicePartiallyPaid, InvoiceIssued, InvoiceOverdue},
+	InvoiceVoid:          {},
+}
+
+// manualInvoiceTransitions lists the moves staff may make by hand: issuing a draft and voiding.
+// Paid, partially paid and overdue follow from payments and the overdue job.
+var manualInvoiceTransitions = map[string][]string{
+	InvoiceDraft:         {InvoiceIssued, InvoiceVoid},
+	InvoiceIssued:        {InvoiceVoid},
+	InvoicePartiallyPaid: {InvoiceVoid},
+	InvoiceOverdue:       {InvoiceVoid},
+	InvoicePaid:          {},
+	InvoiceVoid:          {},
+}
+
+// InvoiceEvent is an entry in an invoice's history
+type InvoiceEvent struct {
+	Type   string    `bson:"type" json:"type"`
+	From   string    `bson:"from,omitempty" json:"from,omitempty"`
+	To     string    `bson:"to,omitempty" json:"to,omitempty"`
+	Amount float64   `bson:"amount,omitempty" json:"amount,omitempty"`
+	Ref    string    `bson:"ref,omitempty" json:"ref,omitempty"`
+	Actor  string    `bson:"actor" json:"actor"`
+	At     time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+var ErrInvoiceNotFound = errors.New("invoice not found")
+var ErrInvoiceHasPayments = errors.New("invoice has payments allocated to it; refund or move them before voiding")
+
+// TransitionError is returned when an invoice cannot move from its current status to the requested one
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("invoice cannot move from %s to %s", e.From, e.To)
+}
+
+// normalizeInvoiceStatus maps statuses written before the lifecycle existed onto it.
+// Anything unknown was posted to the customer balance, so it is treated as issued.
+func normalizeInvoiceStatus(status string) string {
+	if _, ok := invoiceTransitions[status]; ok {
+		return status
+	}
+	return InvoiceIssued
+}
+
+func canTransition(transitions map[string][]string, from, to string) bool {
+	for _, next := range transitions[normalizeInvoiceStatus(from)] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionInvoice moves an invoice to a new status, applying the balance effects of the move
+// and recording it in the invoice history. The update is conditional on the status it was read
+// with, so two concurrent transitions cannot both succeed.
+func transitionInvoice(client *mongo.Client, oid primitive.ObjectID, to string, actor string) (InvoiceGet, error) {
+	return changeInvoiceStatus(client, oid, to, actor, invoiceTransitions)
+}
+
+// changeInvoiceStatus is transitionInvoice limited to the given transitions
+func changeInvoiceStatus(client *mongo.Client, oid primitive.ObjectID, to string, actor string, transitions map[string][]string) (InvoiceGet, error) {
+	collection := client.Database(Database).Collection("invoices")
+	var invoice InvoiceGet
+	err := collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&invoice)
+	if err == mongo.ErrNoDocuments {
+		return invoice, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return invoice, err
+	}
+
+	from := normalizeInvoiceStatus(invoice.Status)
+	if !canTransition(transitions, from, to) {
+		return invoice, &TransitionError{From: from, To: to}
+	}
+
+	// Voiding reverses what the invoice still adds to the balance: its total and late fees less
+	// credit notes. Paid amounts cannot be reversed this way, so invoices with payments are refused.
+	event := InvoiceEvent{Type: "status", From: from, To: to, Actor: actor, At: time.Now()}
+	filter := bson.M{"_id": oid, "status": invoice.Status}
+	if to == InvoiceVoid {
+		if invoice.AmountPaid > 0 {
+			return invoice, ErrInvoiceHasPayments
+		}
+		filter["amountpaid"] = bson.M{"$in": bson.A{0, nil}}
+		if from != InvoiceDraft {
+			event.Amount = invoiceDue(invoice)
+		}
+	}
+	update := bumpVersion(bson.M{"$set": bson.M{"status": to}, "$push": bson.M{"history": event}})
+	result, err := collection.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return invoice, err
+	}
+	if result.MatchedCount == 0 && to == InvoiceVoid {
+		return invoice, ErrInvoiceHasPayments
+	}
+	if result.MatchedCount == 0 {
+		return invoice, &TransitionError{From: from, To: to}
+	}
+
+	// Drafts are not posted to the customer balance or stock; issuing posts them and voiding reverses them.
+	switch {
+	case from == InvoiceDraft && to == InvoiceIssued:
+		_, err = adjustBalance(client, invoice.CustomerID, invoice.Total)
+		if err == nil {
+			err = moveStock(client, stockDeltas(nil, invoice.Items), "invoice", oid.Hex(), actor)
+		}
+	case from != InvoiceDraft && to == InvoiceVoid:
+		_, err = adjustBalance(client, invoice.CustomerID, -event.Amount)
+		if err == nil {
+			err = moveStock(client, stockDeltas(invoice.Items, nil), "invoice_void", oid.Hex(), actor)
+		}
+	}
+	if err != nil {
+		return invoice, err
+	}
+
+	invoice.Status = to
+	invoice.History = append(invoice.History, event)
+	return invoice, nil
+}
+
+// settleInvoiceStatus moves an invoice between issued, partially_paid and paid based on its amount paid
+// and credited.
+// Invoices written before amounts were tracked have no amountpaid and are left alone.
+func settleInvoiceStatus(client *mongo.Client, oid primitive.ObjectID, actor string) error {
+	var invoice InvoiceGet
+	filter := bson.M{"_id": oid, "amountpaid": bson.M{"$exists": true}}
+	err := client.Database(Database).Collection("invoices").FindOne(context.Background(), filter).Decode(&invoice)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if invoice.Status == InvoiceDraft || invoice.Status == InvoiceVoid {
+		return nil
+	}
+
+	// An invoice that is still owed past its due date stays overdue however much has been paid
+	var target string
+	switch {
+	case invoiceDue(invoice) <= 0 && invoice.Total > 0:
+		target = InvoicePaid
+	case !invoice.DueDate.IsZero() && time.Now().After(invoice.DueDate):
+		target = InvoiceOverdue
+	case invoice.AmountPaid <= 0:
+		target = InvoiceIssued
+	default:
+		target = InvoicePartiallyPaid
+	}
+	if normalizeInvoiceStatus(invoice.Status) == target || !canTransition(invoiceTransitions, invoice.Status, target) {
+		return nil
+	}
+	_, err = transitionInvoice(client, oid, target, actor)
+	return err
+}
+
+type StatusRequest struct {
+	Status string `json:"status"`
+}
+
+// setInvoiceStatus applies a manual status transition requested by staff: issuing a draft or
+// voiding. paid and partially_paid are reached by recording payments and overdue by the overdue
+// job, not set by hand.
+func setInvoiceStatus(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req StatusRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := invoiceTransitions[req.Status]; !ok {
+			http.Error(w, "unknown invoice status "+req.Status, http.StatusBadRequest)
+			return
+		}
+		switch req.Status {
+		case InvoicePaid, InvoicePartiallyPaid:
+			http.Error(w, req.Status+" is set by recording a payment", http.StatusConflict)
+			return
+		case InvoiceOverdue:
+			http.Error(w, "overdue is set once an invoice is past its due date", http.StatusConflict)
+			return
+		}
+
+		invoice, err := changeInvoiceStatus(client, oid, req.Status, requestActor(r), manualInvoiceTransitions)
+		var transitionErr *TransitionError
+		if errors.Is(err, ErrInvoiceNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.As(err, &transitionErr) || errors.Is(err, ErrInvoiceHasPayments) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(invoice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// voidInvoice voids an invoice, reversing its effect on the customer balance and stock while
+// keeping it on record
+func voidInvoice(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		invoice, err := transitionInvoice(client, oid, InvoiceVoid, requestActor(r))
+		var transitionErr *TransitionError
+		if errors.Is(err, ErrInvoiceNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.As(err, &transitionErr) || errors.Is(err, ErrInvoiceHasPayments) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(invoice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestNormalizeInvoiceStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{status: InvoiceDraft, want: InvoiceDraft},
+		{status: InvoiceVoid, want: InvoiceVoid},
+		{status: InvoicePartiallyPaid, want: InvoicePartiallyPaid},
+		{status: "", want: InvoiceIssued},
+		{status: "pending", want: InvoiceIssued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			if got := normalizeInvoiceStatus(tt.status); got != tt.want {
+				t.Errorf("normalizeInvoiceStatus(%q) = %q, want %q", tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanTransitionToVoid(t *testing.T) {
+	tests := []struct {
+		from string
+		want bool
+	}{
+		{from: InvoiceDraft, want: true},
+		{from: InvoiceIssued, want: true},
+		{from: InvoicePartiallyPaid, want: true},
+		{from: InvoiceOverdue, want: true},
+		{from: "pending", want: true},
+		{from: InvoicePaid, want: false},
+		{from: InvoiceVoid, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			if got := canTransition(manualInvoiceTransitions, tt.from, InvoiceVoid); got != tt.want {
+				t.Errorf("canTransition(%q, void) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanTransitionByHand(t *testing.T) {
+	tests := []struct {
+		from, to  string
+		byHand    bool
+		automatic bool
+	}{
+		{from: InvoiceDraft, to: InvoiceIssued, byHand: true, automatic: true},
+		{from: InvoiceIssued, to: InvoicePaid, byHand: false, automatic: true},
+		{from: InvoiceIssued, to: InvoiceOverdue, byHand: false, automatic: true},
+		{from: InvoicePaid, to: InvoicePartiallyPaid, byHand: false, automatic: true},
+		{from: InvoiceIssued, to: InvoiceDraft, byHand: false, automatic: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			if got := canTransition(manualInvoiceTransitions, tt.from, tt.to); got != tt.byHand {
+				t.Errorf("by hand = %v, want %v", got, tt.byHand)
+			}
+			if got := canTransition(invoiceTransitions, tt.from, tt.to); got != tt.automatic {
+				t.Errorf("automatically = %v, want %v", got, tt.automatic)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// startJob runs a background job once straight away and then on every tick of the given interval.
+// Errors are logged and the job carries on at the next tick.
+func startJob(client *mongo.Client, name string, every time.Duration, run func(*mongo.Client) error) {
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			err := run(client)
+			if err != nil {
+				log.Println("job", name+":", err.Error())
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -30,7 +30,15 @@ type ItemGet struct {
 	Images        []string           `bson:"images" json:"images"`
 	Type          string             `json:"type"`
 	Status        string             `json:"status"`
-	
+	Stock         int64              `json:"stock"`
+	ReorderLevel  int64              `json:"reorderLevel"`
+	CategoryID    primitive.ObjectID `bson:"categoryId,omitempty" json:"categoryId,omitempty"`
+	SKU           string             `bson:"sku,omitempty" json:"sku"`
+	Unit          string             `json:"unit"`
+	Variants      []Variant          `bson:"variants" json:"variants"`
+	TaxInclusive  bool               `bson:"taxinclusive" json:"taxInclusive"`
+	Version       int64              `bson:"version" json:"version"`
+	ArchivedAt    *time.Time         `bson:"archivedAt,omitempty" json:"archivedAt,omitempty"`
 }
 
 type ItemGetInv struct {
@@ -43,6 +51,13 @@ type ItemGetInv struct {
 	TotalP        float64			`json:"totalp"`
 	Type          string             `json:"type"`
 	Status        string             `json:"status"`
+	VariantSKU    string             `bson:"variantSku,omitempty" json:"variantSku,omitempty"`
+	TaxRate       float64            `bson:"taxrate" json:"taxRate"`
+	TaxInclusive  bool               `bson:"taxinclusive" json:"taxInclusive"`
+	Discount      *Discount          `bson:"discount,omitempty" json:"discount,omitempty"`
+	DiscountAmount float64           `bson:"discountamount" json:"discountAmount"`
+	Taxable       float64            `json:"taxable"`
+	Tax           float64            `json:"tax"`
 	
 }
 type Item struct {
@@ -52,6 +67,13 @@ type Item struct {
 	Images        []string          `bson:"images" json:"images"`
 	Type          string            `json:"type"`
 	Status        string            `json:"status"`
+	Stock         int64             `json:"stock"`
+	ReorderLevel  int64             `json:"reorderLevel"`
+	CategoryID    primitive.ObjectID `bson:"categoryId,omitempty" json:"categoryId,omitempty"`
+	SKU           string            `bson:"sku,omitempty" json:"sku"`
+	Unit          string            `json:"unit"`
+	Variants      []Variant         `bson:"variants" json:"variants"`
+	TaxInclusive  bool              `bson:"taxinclusive" json:"taxInclusive"`
 	
 }
 
@@ -61,7 +83,14 @@ type PaymentCaptureGet struct {
 	Amount      float64            `json:"amount"`
 	StripeID    string				`json:"stripeid"`
 	Mode        string             `json:"mode"`
+	Allocations []PaymentAllocation `bson:"allocations" json:"allocations"`
+	Credit      float64            `json:"credit"`
+	Refunded    float64            `json:"refunded"`
 	CapturedTimestamp time.Time `bson:"timestamp"`
+	Version     int64              `bson:"version" json:"version"`
+	Pending     bool               `bson:"pending,omitempty" json:"pending,omitempty"`
+	Steps       []string           `bson:"steps,omitempty" json:"-"`
+	BalanceAfter float64           `bson:"balanceafter,omitempty" json:"-"`
 }
 
 type PaymentCapture struct {
@@ -69,15 +98,21 @@ type PaymentCapture struct {
 	Amount      float64            `json:"amount"`
 	StripeID    string				`json:"stripeid"`
 	Mode        string             `json:"mode"`
+	Allocations []PaymentAllocation `bson:"allocations" json:"allocations"`
+	Credit      float64            `json:"credit"`
+	Refunded    float64            `json:"refunded"`
 	CapturedTimestamp time.Time `bson:"timestamp"`
+	Pending     bool               `bson:"pending,omitempty" json:"pending,omitempty"`
 }
 type Customer struct {
 	Name          string            `json:"name"`
 	Careof        string            `json:"careof"`
 	Address 	  string            `json:"address"`
 	Balance       float64           `json:"balance"`
+	Credit        float64           `json:"credit"`
 	Description   string			`json:"description"`
-	Number        float64			`json:"number"`
+	Number        PhoneNumber		`json:"number"`
+	Numbers       []PhoneNumber		`bson:"numbers" json:"numbers"`
 	MonthlypayF   float64          	`json:"monthlypayf"`
 	MonthlypayR   float64          	`json:"monthlypayr"`
 	DueDay 		  int64				`json:"dueday"`
@@ -91,31 +126,68 @@ type CustomerGet struct {
 	Careof        string            `json:"careof"`
 	Address 	  string            `json:"address"`
 	Balance       float64           `json:"balance"`
+	Credit        float64           `json:"credit"`
 	Description   string			`json:"description"`
-	Number        float64			`json:"number"`
+	Number        PhoneNumber		`json:"number"`
+	Numbers       []PhoneNumber		`bson:"numbers" json:"numbers"`
 	MonthlypayF   float64          	`json:"monthlypayf"`
 	MonthlypayR   float64          	`json:"monthlypayr"`
 	DueDay 		  int64				`json:"dueday"`
 	Status        string            `json:"status"`
 	CapturedTimestamp time.Time `bson:"timestamp"`
+	Version       int64             `bson:"version" json:"version"`
+	ArchivedAt    *time.Time        `bson:"archivedAt,omitempty" json:"archivedAt,omitempty"`
 }
 
 type Invoice struct {
+	Number        string            `json:"number"`
 	Status        string            `json:"status"`
 	Date          time.Time         `bson:"timestamp"`
-	Customer      CustomerGet       `json:"customer"`
+	CustomerID    primitive.ObjectID `bson:"custId" json:"custId"`
+	Customer      *CustomerGet      `bson:"-" json:"customer,omitempty"`
+	Billing       BillingSnapshot   `bson:"billing" json:"billing"`
 	Items         []ItemGetInv		`json:"items"`
+	Discount      *Discount         `bson:"discount,omitempty" json:"discount,omitempty"`
+	Coupon        string            `bson:"coupon,omitempty" json:"coupon,omitempty"`
+	CouponDiscount *Discount        `bson:"coupondiscount,omitempty" json:"couponDiscount,omitempty"`
+	DiscountTotal float64           `bson:"discounttotal" json:"discountTotal"`
+	Subtotal      float64           `json:"subtotal"`
+	TaxTotal      float64           `bson:"taxtotal" json:"taxTotal"`
+	Taxes         []TaxSummary      `bson:"taxes" json:"taxes"`
 	Total         float64           `json:"total"`
+	AmountPaid    float64           `bson:"amountpaid" json:"amountPaid"`
+	Credited      float64           `bson:"credited" json:"credited"`
+	LateFees      float64           `bson:"latefees" json:"lateFees"`
+	AmountDue     float64           `bson:"amountdue" json:"amountDue"`
+	DueDate       time.Time         `bson:"duedate" json:"dueDate"`
+	History       []InvoiceEvent    `bson:"history" json:"history"`
 
 }
 
 type InvoiceGet struct {
 	ID            primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Number        string            `json:"number"`
 	Status        string            `json:"status"`
 	Date          time.Time         `bson:"timestamp"`
-	Customer      CustomerGet       `json:"customer"`
+	CustomerID    primitive.ObjectID `bson:"custId" json:"custId"`
+	Customer      *CustomerGet      `bson:"-" json:"customer,omitempty"`
+	Billing       BillingSnapshot   `bson:"billing" json:"billing"`
 	Items         []ItemGetInv		`json:"items"`
+	Discount      *Discount         `bson:"discount,omitempty" json:"discount,omitempty"`
+	Coupon        string            `bson:"coupon,omitempty" json:"coupon,omitempty"`
+	CouponDiscount *Discount        `bson:"coupondiscount,omitempty" json:"couponDiscount,omitempty"`
+	DiscountTotal float64           `bson:"discounttotal" json:"discountTotal"`
+	Subtotal      float64           `json:"subtotal"`
+	TaxTotal      float64           `bson:"taxtotal" json:"taxTotal"`
+	Taxes         []TaxSummary      `bson:"taxes" json:"taxes"`
 	Total         float64           `json:"total"`
+	AmountPaid    float64           `bson:"amountpaid" json:"amountPaid"`
+	Credited      float64           `bson:"credited" json:"credited"`
+	LateFees      float64           `bson:"latefees" json:"lateFees"`
+	AmountDue     float64           `bson:"amountdue" json:"amountDue"`
+	DueDate       time.Time         `bson:"duedate" json:"dueDate"`
+	History       []InvoiceEvent    `bson:"history" json:"history"`
+	Version       int64             `bson:"version" json:"version"`
 }
 
 
@@ -133,13 +205,18 @@ func getEnv(Environment string) (string, error) {
 	}
 }
 func main() {
+	// `app migrate up|down [steps]|status` manages the schema instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(os.Args[2:]))
+	}
+
 	// MongoDB client options
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"https://hayath.mamun.cloud"},                            // All origins
-		AllowedMethods:   []string{"POST", "GET", "PUT", "DELETE"}, // Allowing only get, just an example
-		AllowedHeaders:   []string{"Set-Cookie", "Content-Type"},
-		ExposedHeaders:   []string{"Set-Cookie"},
+		AllowedMethods:   []string{"POST", "GET", "PUT", "PATCH", "DELETE"}, // Allowing only get, just an example
+		AllowedHeaders:   []string{"Set-Cookie", "Content-Type", "X-Actor", "X-Admin-Token", "Idempotency-Key", "If-Match"},
+		ExposedHeaders:   []string{"Set-Cookie", "Idempotent-Replayed", "X-Total-Count", "ETag"},
 		AllowCredentials: true,
 		Debug:            true,
 	})
@@ -180,6 +257,24 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Pending migrations are applied on start unless AUTO_MIGRATE=false, in which case they are
+	// run with `app migrate up`
+	if os.Getenv("AUTO_MIGRATE") != "false" {
+		_, err = migrateUp(client)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Scheduled prices are copied onto their items once they take effect
+	startJob(client, "apply-due-prices", time.Minute, applyDuePrices)
+	// Invoices past their due date are marked overdue, and late fees charged, once a day
+	startJob(client, "overdue-invoices", 24*time.Hour, markOverdueInvoices)
+	// Records deleted longer ago than the retention period are removed for good once a day
+	startJob(client, "purge-trash", 24*time.Hour, purgeTrash)
+	// The search index is reloaded in full now and then to catch writes made elsewhere
+	startJob(client, "search-index", searchRebuildInterval, rebuildSearchIndex)
+
 	minioClient, err := minio.New(minioURL, minioKey, minioSecret, true)
 	if err != nil {
 		log.Fatalln(err)
@@ -190,17 +285,31 @@ func main() {
 
 	// Define a POST route to add an item to a collection
 	router.HandleFunc("/items", addItem(client)).Methods("POST")
-	router.HandleFunc("/payment/capture", addPayment(client)).Methods("POST")
-	router.HandleFunc("/payment/capture/{id}", addPaymentInvoice(client)).Methods("POST")
-	router.HandleFunc("/invoices", addInvoice(client)).Methods("POST")
+	router.HandleFunc("/payment/capture", idempotent(client, addPayment(client))).Methods("POST")
+	router.HandleFunc("/payment/capture/{id}", idempotent(client, addPaymentInvoice(client))).Methods("POST")
+	router.HandleFunc("/invoices", idempotent(client, addInvoice(client))).Methods("POST")
 	router.HandleFunc("/payments", getPayments(client)).Methods("GET")
+	router.HandleFunc("/payments/{id}/receipt", getReceipt(client)).Methods("GET")
 	router.HandleFunc("/items", getItems(client)).Methods("GET")
 	router.HandleFunc("/invoices", getInvoices(client)).Methods("GET")
 
 	router.HandleFunc("/items/disabled", getDisabledItems(client)).Methods("GET")
+	router.HandleFunc("/items/low-stock", getLowStockItems(client)).Methods("GET")
+	router.HandleFunc("/items/{id}/stock", adjustStock(client)).Methods("POST")
+	router.HandleFunc("/items/{id}/stock-movements", getStockMovements(client)).Methods("GET")
+	router.HandleFunc("/items/{id}/prices", schedulePrice(client)).Methods("POST")
+	router.HandleFunc("/items/{id}/prices", getPriceHistory(client)).Methods("GET")
+	router.HandleFunc("/items/{id}/price", getPriceAt(client)).Methods("GET")
+
+	router.HandleFunc("/categories", addCategory(client)).Methods("POST")
+	router.HandleFunc("/categories", getCategories(client)).Methods("GET")
+	router.HandleFunc("/categories/migrate-types", migrateItemTypesHandler(client)).Methods("POST")
+	router.HandleFunc("/categories/{id}", editCategory(client)).Methods("PUT")
+	router.HandleFunc("/categories/{id}", deleteCategory(client)).Methods("DELETE")
 
 	router.HandleFunc("/items/{id}", getItem(client)).Methods("GET")
 	router.HandleFunc("/invoices/{id}", getInvoice(client)).Methods("GET")
+	router.HandleFunc("/invoices/number/{number}", getInvoiceByNumber(client)).Methods("GET")
 
 	// Define a DELETE route to delete an item from a collection
 	router.HandleFunc("/items/{id}", deleteItem(client)).Methods("DELETE")
@@ -209,15 +318,38 @@ func main() {
 	router.HandleFunc("/items/disabled/{id}", disableItem(client)).Methods("DELETE")
 
 	router.HandleFunc("/items/enabled/{id}", enableItem(client)).Methods("GET")
-	router.HandleFunc("/invoices/status/{id}/{status}", setInvoiceStatus(client)).Methods("GET")
+	router.HandleFunc("/invoices/{id}/status", setInvoiceStatus(client)).Methods("POST")
+	router.HandleFunc("/invoices/{id}/void", voidInvoice(client)).Methods("POST")
+	router.HandleFunc("/invoices/{id}/reassign", reassignInvoiceHandler(client)).Methods("POST")
+	router.HandleFunc("/invoices/{id}/stripe/payment-intent", idempotent(client, createPaymentIntent(client))).Methods("POST")
+	router.HandleFunc("/invoices/{id}/stripe/checkout", idempotent(client, createCheckoutSession(client))).Methods("POST")
+	router.HandleFunc("/webhooks/stripe", stripeWebhook(client)).Methods("POST")
 
 	router.HandleFunc("/upload", Upload(minioClient, minioURL)).Methods("POST")
 
 	// Define a PUT route to edit an item in a collection
 	router.HandleFunc("/items/{id}", editItem(client)).Methods("PUT")
+	router.HandleFunc("/items/{id}", patchItem(client)).Methods("PATCH")
 	router.HandleFunc("/payments/{id}", editPayment(client)).Methods("PUT")
+	router.HandleFunc("/payments/{id}", patchPayment(client)).Methods("PATCH")
 	router.HandleFunc("/payments/revert/{id}", revertPayment(client)).Methods("DELETE")
+	router.HandleFunc("/payments/{id}", getPayment(client)).Methods("GET")
+	router.HandleFunc("/payments/{id}", deletePayment(client)).Methods("DELETE")
+	router.HandleFunc("/trash", getTrash(client)).Methods("GET")
+	router.HandleFunc("/trash/{kind}/{id}/restore", restoreDeleted(client)).Methods("POST")
+	router.HandleFunc("/payments/{id}/refund", idempotent(client, addRefund(client))).Methods("POST")
+	router.HandleFunc("/refunds", getRefunds(client)).Methods("GET")
+	router.HandleFunc("/invoices/{id}/credit-notes", idempotent(client, addCreditNote(client))).Methods("POST")
+	router.HandleFunc("/credit-notes", getCreditNotes(client)).Methods("GET")
+	router.HandleFunc("/reports/tax", getTaxReport(client)).Methods("GET")
+	router.HandleFunc("/reports/aging", getAgingReport(client)).Methods("GET")
+	router.HandleFunc("/search", searchHandler(client)).Methods("GET")
+	router.HandleFunc("/adjustments", getAdjustments(client)).Methods("GET")
+	router.HandleFunc("/coupons", addCoupon(client)).Methods("POST")
+	router.HandleFunc("/coupons", getCoupons(client)).Methods("GET")
+	router.HandleFunc("/coupons/{code}", disableCoupon(client)).Methods("DELETE")
 	router.HandleFunc("/invoices/{id}", editInvoice(client)).Methods("PUT")
+	router.HandleFunc("/invoices/{id}", patchInvoice(client)).Methods("PATCH")
 	
 
 	// Define a POST route to add an item to a collection
@@ -236,6 +368,16 @@ func main() {
 
 	// Define a PUT route to edit an item in a collection
 	router.HandleFunc("/customer/{id}", editCustomer(client)).Methods("PUT")
+	router.HandleFunc("/customer/{id}", patchCustomer(client)).Methods("PATCH")
+
+	router.HandleFunc("/customer/{id}/credit/apply", idempotent(client, applyCustomerCredit(client))).Methods("POST")
+	router.HandleFunc("/customer/{id}/balance-adjustments", idempotent(client, addBalanceAdjustment(client))).Methods("POST")
+	router.HandleFunc("/customer/{id}/statement", getCustomerStatement(client)).Methods("GET")
+	router.HandleFunc("/customer/{id}/invoices", getCustomerInvoices(client)).Methods("GET")
+	router.HandleFunc("/customer/{id}/payments", getCustomerPayments(client)).Methods("GET")
+	router.HandleFunc("/customer/{id}/prices", setCustomerPrice(client)).Methods("PUT")
+	router.HandleFunc("/customer/{id}/prices", getCustomerPrices(client)).Methods("GET")
+	router.HandleFunc("/customer/{id}/prices/{itemId}", deleteCustomerPrice(client)).Methods("DELETE")
 	
 	// Start the HTTP server
 	log.Println("Starting HTTP server...")
@@ -326,9 +468,46 @@ func addItem(client *mongo.Client) http.HandlerFunc {
 
 		log.Println(item)
 
+		err = validateCatalogFields(client, primitive.NilObjectID, item.Unit, item.CategoryID, item.SKU, item.Variants)
+		if err != nil {
+			http.Error(w, err.Error(), itemErrorStatus(err))
+			return
+		}
+
 		// Insert the item into the "items" collection in MongoDB
+		// The opening stock is recorded as a movement so the stock history adds up
+		opening := map[StockKey]int64{{}: item.Stock}
+		item.Stock = 0
+		for i := range item.Variants {
+			opening[StockKey{VariantSKU: item.Variants[i].SKU}] = item.Variants[i].Stock
+			item.Variants[i].Stock = 0
+		}
 		collection := client.Database(Database).Collection("products")
-		_, err = collection.InsertOne(context.Background(), item)
+		result, err := collection.InsertOne(context.Background(), item)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, itemErrorMessage(err), itemErrorStatus(err))
+			return
+		}
+		updateSearchIndex(client, "products", result.InsertedID.(primitive.ObjectID))
+		deltas := map[StockKey]int64{}
+		for key, qty := range opening {
+			key.ItemID = result.InsertedID.(primitive.ObjectID)
+			deltas[key] = qty
+		}
+		err = moveStock(client, deltas, "opening", "", requestActor(r))
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Start the price history with the opening prices
+		itemID := result.InsertedID.(primitive.ObjectID)
+		err = recordPrice(client, StockKey{ItemID: itemID}, item.Price, time.Now(), requestActor(r))
+		for i := 0; err == nil && i < len(item.Variants); i++ {
+			err = recordPrice(client, StockKey{ItemID: itemID, VariantSKU: item.Variants[i].SKU}, item.Variants[i].Price, time.Now(), requestActor(r))
+		}
 		if err != nil {
 			log.Println(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -352,29 +531,109 @@ func addInvoice(client *mongo.Client) http.HandlerFunc {
 		}
 
 		item.Date = time.Now()
+		// The invoice keeps the customer id and a copy of the billing details as they are today
+		item.CustomerID = invoiceCustomerID(item.CustomerID, item.Customer)
+		var customer CustomerGet
+		err = client.Database(Database).Collection("customer").FindOne(context.Background(), notDeleted(nil, bson.M{"_id": item.CustomerID})).Decode(&customer)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "customer not found", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if customer.ArchivedAt != nil {
+			http.Error(w, "customer is archived", http.StatusBadRequest)
+			return
+		}
+		archived, err := archivedItem(client, item.Items)
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if archived != "" {
+			http.Error(w, "item "+archived+" is archived", http.StatusBadRequest)
+			return
+		}
+		item.Customer = nil
+		item.Billing = billingSnapshot(customer)
+		if item.Coupon != "" {
+			coupon, err := redeemCoupon(client, item.Coupon, item.Date)
+			if err != nil {
+				releaseIdempotencyKey(w)
+				http.Error(w, err.Error(), invoiceErrorStatus(err))
+				return
+			}
+			item.Coupon = coupon.Code
+			item.CouponDiscount = &coupon.Discount
+		}
+		// The coupon use is given back if the invoice is not saved
+		saved := false
+		defer func() {
+			if item.Coupon != "" && !saved {
+				releaseCoupon(client, item.Coupon)
+			}
+		}()
+		// Line prices, discounts and tax are worked out here rather than trusted from the client
+		totals, err := calculateInvoice(client, item.CustomerID, item.Items, item.Date, item.Discount, item.CouponDiscount)
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), invoiceErrorStatus(err))
+			return
+		}
+		item.DiscountTotal = totals.DiscountTotal
+		item.Subtotal = totals.Subtotal
+		item.TaxTotal = totals.TaxTotal
+		item.Taxes = totals.Taxes
+		item.Total = totals.Total
+		// New invoices are issued straight away unless explicitly saved as a draft
+		if item.Status != InvoiceDraft {
+			item.Status = InvoiceIssued
+		}
+		item.History = []InvoiceEvent{{Type: "status", To: item.Status, Actor: requestActor(r), At: item.Date}}
+		item.AmountPaid = 0
+		item.Credited = 0
+		item.LateFees = 0
+		item.AmountDue = item.Total
+		item.DueDate = invoiceDueDate(item.Date, customer.DueDay)
+		item.Number, err = nextInvoiceNumber(client, item.Date)
+		if err != nil {
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		log.Println(item)
 
 		// Insert the item into the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("invoices")
-		_, err = collection.InsertOne(context.Background(), item)
+		result, err := collection.InsertOne(context.Background(), item)
 		if err != nil {
 			log.Println(err.Error())
+			releaseIdempotencyKey(w)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		saved = true
 
-		collection = client.Database(Database).Collection("customer")
-		filter := bson.M{"_id": item.Customer.ID}
-		previousCust := CustomerGet{}
-		err = collection.FindOne(context.Background(), bson.M{"_id": item.Customer.ID}).Decode(&previousCust)
+		// Drafts are posted to the balance and take stock when they are issued
+		if item.Status == InvoiceDraft {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		err = moveStock(client, stockDeltas(nil, item.Items), "invoice", result.InsertedID.(primitive.ObjectID).Hex(), requestActor(r))
 		if err != nil {
+			log.Println(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		newBalance := previousCust.Balance + item.Total
-		update := bson.M{"$set": bson.M{"balance": newBalance}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+
+		_, err = adjustBalance(client, item.CustomerID, item.Total)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -392,20 +651,12 @@ func addPaymentInvoice(client *mongo.Client) http.HandlerFunc {
 		id := vars["id"]
 
 		fmt.Println(id)
-		oid, err := primitive.ObjectIDFromHex(id)
+		invoiceOid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		collection := client.Database(Database).Collection("invoices")
-		filter := bson.M{"_id": oid}
-		update := bson.M{"$set": bson.M{"status": "paid"}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
 		// Parse the request body into an Item struct
 		var item PaymentCapture
 		err = json.NewDecoder(r.Body).Decode(&item)
@@ -418,37 +669,14 @@ func addPaymentInvoice(client *mongo.Client) http.HandlerFunc {
 
 		log.Println(item)
 
-		// Insert the item into the "items" collection in MongoDB
-		collection = client.Database(Database).Collection("payments")
-		_, err = collection.InsertOne(context.Background(), item)
+		paymentID, err := captureInvoicePayment(client, invoiceOid, &item, requestActor(r))
 		if err != nil {
 			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		oid, err = primitive.ObjectIDFromHex(item.CustomerID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		collection = client.Database(Database).Collection("customer")
-		filter = bson.M{"_id": oid}
-		previousCust := CustomerGet{}
-		err = collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&previousCust)
-		if err != nil {                                                                                        
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		newBalance := previousCust.Balance - item.Amount
-		if newBalance <= 0 {
-
-		}
-		update = bson.M{"$set": bson.M{"balance": newBalance}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// Nothing is recorded until the payment itself is inserted
+			if paymentID.IsZero() {
+				releaseIdempotencyKey(w)
+			}
+			http.Error(w, err.Error(), paymentErrorStatus(err))
 			return
 		}
 
@@ -473,37 +701,14 @@ func addPayment(client *mongo.Client) http.HandlerFunc {
 
 		log.Println(item)
 
-		// Insert the item into the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("payments")
-		_, err = collection.InsertOne(context.Background(), item)
+		// Without explicit allocations the payment is applied to the oldest open invoices
+		paymentID, err := capturePayment(client, &item, requestActor(r))
 		if err != nil {
 			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		oid, err := primitive.ObjectIDFromHex(item.CustomerID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		collection = client.Database(Database).Collection("customer")
-		filter := bson.M{"_id": oid}
-		previousCust := CustomerGet{}
-		err = collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&previousCust)
-		if err != nil {                                                                                        
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		newBalance := previousCust.Balance - item.Amount
-		if newBalance <= 0 {
-
-		}
-		update := bson.M{"$set": bson.M{"balance": newBalance}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			if paymentID.IsZero() {
+				releaseIdempotencyKey(w)
+			}
+			http.Error(w, err.Error(), paymentErrorStatus(err))
 			return
 		}
 
@@ -524,15 +729,26 @@ func addCustomer(client *mongo.Client) http.HandlerFunc {
 		}
 		log.Println(item)
 		item.CapturedTimestamp = time.Now()
+		item.Credit = 0
+		item.Number, item.Numbers, err = normalizePhones(item.Number, item.Numbers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		log.Println(item)
 
 		// Insert the item into the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("customer")
-		_, err = collection.InsertOne(context.Background(), item)
+		result, err := collection.InsertOne(context.Background(), item)
+		if mongo.IsDuplicateKeyError(err) {
+			writePhoneConflict(w, client, item.Numbers, primitive.NilObjectID, err)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		updateSearchIndex(client, "customer", result.InsertedID.(primitive.ObjectID))
 
 		// Send a success response
 		w.WriteHeader(http.StatusCreated)
@@ -547,21 +763,14 @@ func deleteItem(client *mongo.Client) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		// Delete the item from the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("products")
+		// Delete the item from the "items" collection in MongoDB, unless invoices still refer to it
 		oid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		_, err = collection.DeleteOne(context.Background(), bson.M{"_id": oid})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Send a success response
-		w.WriteHeader(http.StatusOK)
+		blockers, cascade := itemDependents(oid)
+		guardedDelete(w, r, client, "products", oid, 0, blockers, cascade)
 	}
 }
 
@@ -579,12 +788,30 @@ func deleteInvoice(client *mongo.Client) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		_, err = collection.DeleteOne(context.Background(), bson.M{"_id": oid})
+		previousInv := InvoiceGet{}
+		err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&previousInv)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "invoice not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		// Only drafts, which never touched the balance or stock, can be deleted.
+		// Issued invoices are voided instead so they stay on record.
+		// The coupon use is given back when the draft is purged from the trash.
+		deleted, err := softDelete(client, "invoices", bson.M{"_id": oid, "status": InvoiceDraft}, requestActor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "only draft invoices can be deleted; void the invoice instead", http.StatusConflict)
+			return
+		}
+
 		// Send a success response
 		w.WriteHeader(http.StatusOK)
 	}
@@ -597,21 +824,25 @@ func deleteCustomer(client *mongo.Client) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		// Delete the item from the "items" collection in MongoDB
+		// Delete the customer, unless they still have records or a balance
 		collection := client.Database(Database).Collection("customer")
 		oid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		_, err = collection.DeleteOne(context.Background(), bson.M{"_id": oid})
+		var customer CustomerGet
+		err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&customer)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "customer not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// Send a success response
-		w.WriteHeader(http.StatusOK)
+		blockers, cascade := customerDependents(oid)
+		guardedDelete(w, r, client, "customer", oid, customer.Balance, blockers, cascade)
 	}
 }
 
@@ -624,9 +855,15 @@ func editItem(client *mongo.Client) http.HandlerFunc {
 
 		fmt.Println(id)
 
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Parse the request body into an Item struct
 		var item ItemGet
-		err := json.NewDecoder(r.Body).Decode(&item)
+		err = json.NewDecoder(r.Body).Decode(&item)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -634,17 +871,106 @@ func editItem(client *mongo.Client) http.HandlerFunc {
 
 		fmt.Println(item)
 
+		// The URL names the record; a body id may only repeat it
+		if !item.ID.IsZero() && item.ID != oid {
+			http.Error(w, "id in the body does not match the URL", http.StatusBadRequest)
+			return
+		}
+		item.ID = oid
+
 		// tables := item.TableAttached
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeVersionError(w, err)
+			return
+		}
 
-		// Update the item in the "items" collection in MongoDB
+		err = validateCatalogFields(client, oid, item.Unit, item.CategoryID, item.SKU, item.Variants)
+		if err != nil {
+			http.Error(w, err.Error(), itemErrorStatus(err))
+			return
+		}
+
+		// Stock only changes through stock movements, so variants keep the stock they already hold
 		collection := client.Database(Database).Collection("products")
-		filter := bson.M{"_id": item.ID}
-		update := bson.M{"$set": bson.M{"name": item.Name, "description": item.Description, "status": item.Status, "images": item.Images, "type": item.Type, "price": item.Price}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		var previous ItemGet
+		err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&previous)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if previous.Version != version {
+			writeStale(w, previous, previous.Version)
+			return
+		}
+		held := map[string]int64{}
+		prices := map[string]float64{}
+		for _, variant := range previous.Variants {
+			held[variant.SKU] = variant.Stock
+			prices[variant.SKU] = variant.Price
+		}
+		for i := range item.Variants {
+			item.Variants[i].Stock = held[item.Variants[i].SKU]
+		}
+
+		// Price changes made here take effect immediately and go into the price history;
+		// future changes are scheduled through POST /items/{id}/prices
+		changed := map[StockKey]float64{}
+		if item.Price != previous.Price {
+			changed[StockKey{ItemID: item.ID}] = item.Price
+		}
+		for _, variant := range item.Variants {
+			if old, ok := prices[variant.SKU]; !ok || old != variant.Price {
+				changed[StockKey{ItemID: item.ID, VariantSKU: variant.SKU}] = variant.Price
+			}
+		}
+
+		// Update the item in the "items" collection in MongoDB, if nobody else has since
+		filter := versionFilter(notDeleted(nil, bson.M{"_id": oid}), version)
+		set := bson.M{"name": item.Name, "description": item.Description, "status": item.Status, "images": item.Images, "type": item.Type, "price": item.Price, "reorderlevel": item.ReorderLevel, "unit": item.Unit, "variants": item.Variants, "taxinclusive": item.TaxInclusive}
+		// Empty SKUs and categories are removed rather than stored so the sparse unique index ignores them
+		unset := bson.M{}
+		if item.CategoryID.IsZero() {
+			unset["categoryId"] = ""
+		} else {
+			set["categoryId"] = item.CategoryID
+		}
+		if item.SKU == "" {
+			unset["sku"] = ""
+		} else {
+			set["sku"] = item.SKU
+		}
+		update := bumpVersion(bson.M{"$set": set})
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		result, err := collection.UpdateOne(context.Background(), filter, update)
+		if err != nil {
+			http.Error(w, itemErrorMessage(err), itemErrorStatus(err))
+			return
+		}
+		if result.MatchedCount == 0 {
+			err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&previous)
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "item not found", http.StatusNotFound)
+				return
+			}
+			writeStale(w, previous, previous.Version)
+			return
+		}
+		updateSearchIndex(client, "products", item.ID)
+
+		for key, price := range changed {
+			err = recordPrice(client, key, price, time.Now(), requestActor(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
 		// Send a success response
 		w.WriteHeader(http.StatusOK)
@@ -669,8 +995,12 @@ func editInvoice(client *mongo.Client) http.HandlerFunc {
 		}
 
 		fmt.Println(item)
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeVersionError(w, err)
+			return
+		}
 		previousInv := InvoiceGet{}
-		previousCust := CustomerGet{}
 		oid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -682,37 +1012,68 @@ func editInvoice(client *mongo.Client) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		collection = client.Database(Database).Collection("customer")
-		err = collection.FindOne(context.Background(), bson.M{"_id": item.Customer.ID}).Decode(&previousCust)
+		if previousInv.Version != version {
+			writeStale(w, previousInv, previousInv.Version)
+			return
+		}
+		if previousInv.Status == InvoiceVoid {
+			http.Error(w, "void invoices cannot be edited", http.StatusConflict)
+			return
+		}
+		// Moving an invoice to another customer changes two balances, so it has its own endpoint
+		custID := invoiceCustomerID(item.CustomerID, item.Customer)
+		if !custID.IsZero() && custID != previousInv.CustomerID {
+			http.Error(w, "use POST /invoices/{id}/reassign to move an invoice to another customer", http.StatusConflict)
+			return
+		}
+		// Edited lines are priced as of the invoice date, not today, and taxed again.
+		// A coupon used when the invoice was created keeps applying.
+		totals, err := calculateInvoice(client, previousInv.CustomerID, item.Items, previousInv.Date, item.Discount, previousInv.CouponDiscount)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), invoiceErrorStatus(err))
 			return
 		}
-
-		collection = client.Database(Database).Collection("customer")
-		filter := bson.M{"_id": item.Customer.ID}
-		log.Println("cust bal:", previousCust.Balance)
-		log.Println("prev inv:", previousInv.Total)
-		resetBalance := previousCust.Balance - previousInv.Total
-		log.Println("reset:", resetBalance)
-		newBalance := resetBalance + item.Total
-		log.Println("new bal:", newBalance)
-		update := bson.M{"$set": bson.M{"balance": newBalance}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		item.Total = totals.Total
+		if item.Total+previousInv.LateFees < previousInv.AmountPaid+previousInv.Credited {
+			http.Error(w, fmt.Sprintf("total cannot be less than the %.2f already paid or credited", previousInv.AmountPaid+previousInv.Credited), http.StatusConflict)
+			return
+		}
+		// Update the item in the "items" collection in MongoDB, if nobody else has since.
+		// Status is changed through POST /invoices/{id}/status only
+		filter := versionFilter(bson.M{"_id": oid}, version)
+		update := bumpVersion(bson.M{"$set": bson.M{"discount": item.Discount, "discounttotal": totals.DiscountTotal, "subtotal": totals.Subtotal, "taxtotal": totals.TaxTotal, "taxes": totals.Taxes, "total": item.Total, "amountdue": roundMoney(item.Total + previousInv.LateFees - previousInv.AmountPaid - previousInv.Credited), "items": item.Items}})
+		result, err := collection.UpdateOne(context.Background(), filter, update)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if result.MatchedCount == 0 {
+			collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&previousInv)
+			writeStale(w, previousInv, previousInv.Version)
+			return
+		}
 
+		// Drafts have not been posted to the balance, so there is nothing to adjust
+		posted := previousInv.Status != InvoiceDraft
 
+		// The customer is not changed here; the balance of the invoice's own customer moves by the difference
+		if posted {
+			newBalance, err := adjustBalance(client, previousInv.CustomerID, item.Total-previousInv.Total)
+			log.Println("new bal:", newBalance)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
+			err = moveStock(client, stockDeltas(previousInv.Items, item.Items), "invoice_edit", id, requestActor(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
-		// Update the item in the "items" collection in MongoDB
-		collection = client.Database(Database).Collection("invoices")
-		filter = bson.M{"_id": item.ID}
-		update = bson.M{"$set": bson.M{"total": item.Total, "items": item.Items, "status": item.Status, "customer": item.Customer}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		// A new total can settle or reopen the invoice
+		err = settleInvoiceStatus(client, oid, requestActor(r))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -741,15 +1102,23 @@ func editPayment(client *mongo.Client) http.HandlerFunc {
 		}
 
 		fmt.Println(item)
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeVersionError(w, err)
+			return
+		}
 		previousPayment := PaymentCaptureGet{}
-		previousCust := CustomerGet{}
 		oid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		collection := client.Database(Database).Collection("payments")
-		err = collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&previousPayment)
+		err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&previousPayment)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "payment not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -761,97 +1130,81 @@ func editPayment(client *mongo.Client) http.HandlerFunc {
 			return
 		}
 
-		collection = client.Database(Database).Collection("customer")
-		err = collection.FindOne(context.Background(), bson.M{"_id": coid}).Decode(&previousCust)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if previousPayment.Version != version {
+			writeStale(w, previousPayment, previousPayment.Version)
 			return
 		}
-
-		
-		filter := bson.M{"_id": coid}
-		log.Println("cust bal:", previousCust.Balance)
-		log.Println("prev amount:", previousPayment.Amount)
-		resetBalance := previousCust.Balance + previousPayment.Amount
-		log.Println("reset:", resetBalance)
-		newBalance := resetBalance - item.Amount
-		log.Println("new bal:", newBalance)
-		update := bson.M{"$set": bson.M{"balance": newBalance}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		if previousPayment.Refunded > 0 {
+			http.Error(w, "a refunded payment cannot be edited", http.StatusConflict)
+			return
+		}
+		if previousPayment.Pending {
+			http.Error(w, "the payment is still being recorded", http.StatusConflict)
+			return
+		}
+		// Allocations stay as they are, so the amount can only change the part kept as credit
+		allocated := allocatedTotal(previousPayment.Allocations)
+		if allocated > 0 && item.CustomerID != previousPayment.CustomerID {
+			http.Error(w, "an allocated payment cannot be moved to another customer", http.StatusConflict)
+			return
+		}
+		if item.Amount < allocated {
+			http.Error(w, fmt.Sprintf("amount cannot be less than the %.2f allocated to invoices", allocated), http.StatusConflict)
+			return
+		}
+		newCredit := roundMoney(item.Amount - allocated)
+		previousCoid, err := primitive.ObjectIDFromHex(previousPayment.CustomerID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-
-
-
-		// Update the item in the "items" collection in MongoDB
-		collection = client.Database(Database).Collection("payments")
-		filter = bson.M{"_id": item.ID}
-		update = bson.M{"$set": bson.M{"custId": item.CustomerID, "amount": item.Amount, "stripeid": item.StripeID, "mode": item.Mode}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		count, err := client.Database(Database).Collection("customer").CountDocuments(context.Background(), notDeleted(nil, bson.M{"_id": coid}))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if count == 0 {
+			http.Error(w, "customer not found", http.StatusBadRequest)
+			return
+		}
 
-		// Send a success response
-		w.WriteHeader(http.StatusOK)
-	}
-}
-
-// editItem updates an item in the "items" collection in MongoDB
-func revertPayment(client *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get the name parameter from the request URL
-		vars := mux.Vars(r)
-		id := vars["id"]
-
-		fmt.Println(id)
-
-		previousPayment := PaymentCaptureGet{}
-		previousCust := CustomerGet{}
-		oid, err := primitive.ObjectIDFromHex(id)
+		// Update the item in the "items" collection in MongoDB, if nobody else has since
+		filter := versionFilter(notDeleted(nil, bson.M{"_id": oid}), version)
+		update := bumpVersion(bson.M{"$set": bson.M{"customerid": item.CustomerID, "amount": item.Amount, "credit": newCredit, "stripeid": item.StripeID, "mode": item.Mode}})
+		result, err := collection.UpdateOne(context.Background(), filter, update)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		collection := client.Database(Database).Collection("payments")
-		err = collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&previousPayment)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if result.MatchedCount == 0 {
+			err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&previousPayment)
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "payment not found", http.StatusNotFound)
+				return
+			}
+			writeStale(w, previousPayment, previousPayment.Version)
 			return
 		}
 
-		coid, err := primitive.ObjectIDFromHex(previousPayment.CustomerID)
+		// The old amount goes back onto the previous customer's balance and the new amount comes off
+		// the payment's customer, who may be the same one
+		_, err = adjustBalance(client, previousCoid, previousPayment.Amount)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		collection = client.Database(Database).Collection("customer")
-		err = collection.FindOne(context.Background(), bson.M{"_id": coid}).Decode(&previousCust)
+		_, err = adjustBalance(client, coid, -item.Amount)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		
-		filter := bson.M{"_id": coid}
-		log.Println("cust bal:", previousCust.Balance)
-		log.Println("prev amount:", previousPayment.Amount)
-		resetBalance := previousCust.Balance + previousPayment.Amount
-		log.Println("reset:", resetBalance)
-		update := bson.M{"$set": bson.M{"balance": resetBalance}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		err = adjustCredit(client, previousCoid, -previousPayment.Credit)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		collection = client.Database(Database).Collection("payments")
-		_, err = collection.DeleteOne(context.Background(), bson.M{"_id": oid})
+		err = adjustCredit(client, coid, newCredit)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -862,8 +1215,8 @@ func revertPayment(client *mongo.Client) http.HandlerFunc {
 	}
 }
 
-// editItem updates an item in the "items" collection in MongoDB
-func editCustomer(client *mongo.Client) http.HandlerFunc {
+// revertPayment refunds whatever is left of a payment; the payment itself is kept for the record
+func revertPayment(client *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the name parameter from the request URL
 		vars := mux.Vars(r)
@@ -871,25 +1224,16 @@ func editCustomer(client *mongo.Client) http.HandlerFunc {
 
 		fmt.Println(id)
 
-		// Parse the request body into an Item struct
-		var item CustomerGet
-		err := json.NewDecoder(r.Body).Decode(&item)
+		oid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		fmt.Println(item)
-
-		// tables := item.TableAttached
-
-		// Update the item in the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("customer")
-		filter := bson.M{"_id": item.ID}
-		update := bson.M{"$set": bson.M{"name": item.Name, "careof": item.Careof, "status": item.Status, "address": item.Address, "number": item.Number, "balance": item.Balance, "dueday": item.DueDay, "monthlypayf": item.MonthlypayF, "monthlypayr": item.MonthlypayR, "description": item.Description}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		_, err = refundPayment(client, oid, 0, "reverted", requestActor(r))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err.Error())
+			http.Error(w, err.Error(), refundErrorStatus(err))
 			return
 		}
 
@@ -898,7 +1242,8 @@ func editCustomer(client *mongo.Client) http.HandlerFunc {
 	}
 }
 
-func disableItem(client *mongo.Client) http.HandlerFunc {
+// editItem updates an item in the "items" collection in MongoDB
+func editCustomer(client *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the name parameter from the request URL
 		vars := mux.Vars(r)
@@ -908,26 +1253,73 @@ func disableItem(client *mongo.Client) http.HandlerFunc {
 
 		oid, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Update the item in the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("products")
-		filter := bson.M{"_id": oid}
-		update := bson.M{"$set": bson.M{"status": "disabled"}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
+		// Parse the request body into an Item struct
+		var item CustomerGet
+		err = json.NewDecoder(r.Body).Decode(&item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Println(item)
+
+		// The URL names the record; a body id may only repeat it
+		if !item.ID.IsZero() && item.ID != oid {
+			http.Error(w, "id in the body does not match the URL", http.StatusBadRequest)
+			return
+		}
+		item.ID = oid
+
+		// tables := item.TableAttached
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeVersionError(w, err)
+			return
+		}
+		item.Number, item.Numbers, err = normalizePhones(item.Number, item.Numbers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Balance and credit only change through invoices, payments, credit notes and
+		// POST /customer/{id}/balance-adjustments, so they are left as they are
+		collection := client.Database(Database).Collection("customer")
+
+		// Update the item in the "items" collection in MongoDB, if nobody else has since
+		filter := versionFilter(notDeleted(nil, bson.M{"_id": oid}), version)
+		update := bumpVersion(bson.M{"$set": bson.M{"name": item.Name, "careof": item.Careof, "status": item.Status, "address": item.Address, "number": item.Number, "numbers": item.Numbers, "dueday": item.DueDay, "monthlypayf": item.MonthlypayF, "monthlypayr": item.MonthlypayR, "description": item.Description}})
+		result, err := collection.UpdateOne(context.Background(), filter, update)
+		if mongo.IsDuplicateKeyError(err) {
+			writePhoneConflict(w, client, item.Numbers, item.ID, err)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if result.MatchedCount == 0 {
+			var current CustomerGet
+			err = collection.FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&current)
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "customer not found", http.StatusNotFound)
+				return
+			}
+			writeStale(w, current, current.Version)
+			return
+		}
+		updateSearchIndex(client, "customer", item.ID)
 
 		// Send a success response
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func disableCustomer(client *mongo.Client) http.HandlerFunc {
+func disableItem(client *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the name parameter from the request URL
 		vars := mux.Vars(r)
@@ -942,9 +1334,9 @@ func disableCustomer(client *mongo.Client) http.HandlerFunc {
 		}
 
 		// Update the item in the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("customer")
+		collection := client.Database(Database).Collection("products")
 		filter := bson.M{"_id": oid}
-		update := bson.M{"$set": bson.M{"status": "disabled"}}
+		update := bumpVersion(bson.M{"$set": bson.M{"status": "disabled"}})
 		_, err = collection.UpdateOne(context.Background(), filter, update)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -956,7 +1348,7 @@ func disableCustomer(client *mongo.Client) http.HandlerFunc {
 	}
 }
 
-func enableItem(client *mongo.Client) http.HandlerFunc {
+func disableCustomer(client *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the name parameter from the request URL
 		vars := mux.Vars(r)
@@ -971,9 +1363,9 @@ func enableItem(client *mongo.Client) http.HandlerFunc {
 		}
 
 		// Update the item in the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("products")
+		collection := client.Database(Database).Collection("customer")
 		filter := bson.M{"_id": oid}
-		update := bson.M{"$set": bson.M{"status": "active"}}
+		update := bumpVersion(bson.M{"$set": bson.M{"status": "disabled"}})
 		_, err = collection.UpdateOne(context.Background(), filter, update)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -985,12 +1377,11 @@ func enableItem(client *mongo.Client) http.HandlerFunc {
 	}
 }
 
-func setInvoiceStatus(client *mongo.Client) http.HandlerFunc {
+func enableItem(client *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the name parameter from the request URL
 		vars := mux.Vars(r)
 		id := vars["id"]
-		status := vars["status"]
 
 		fmt.Println(id)
 
@@ -1001,9 +1392,9 @@ func setInvoiceStatus(client *mongo.Client) http.HandlerFunc {
 		}
 
 		// Update the item in the "items" collection in MongoDB
-		collection := client.Database(Database).Collection("invoices")
+		collection := client.Database(Database).Collection("products")
 		filter := bson.M{"_id": oid}
-		update := bson.M{"$set": bson.M{"status": status}}
+		update := bumpVersion(bson.M{"$set": bson.M{"status": "active"}})
 		_, err = collection.UpdateOne(context.Background(), filter, update)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1032,7 +1423,7 @@ func enableCustomer(client *mongo.Client) http.HandlerFunc {
 		// Update the item in the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("customer")
 		filter := bson.M{"_id": oid}
-		update := bson.M{"$set": bson.M{"status": "active"}}
+		update := bumpVersion(bson.M{"$set": bson.M{"status": "active"}})
 		_, err = collection.UpdateOne(context.Background(), filter, update)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1050,7 +1441,7 @@ func getItems(client *mongo.Client) http.HandlerFunc {
 		// Get all items from the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("products")
 		findOptions := options.Find().SetSort(bson.D{{Key: "name", Value: 1}}) 
-		cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{}), findOptions)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1085,7 +1476,7 @@ func getInvoices(client *mongo.Client) http.HandlerFunc {
 		// Get all items from the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("invoices")
 		findOptions := options.Find().SetSort(bson.D{{Key: "name", Value: 1}}) 
-		cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{}), findOptions)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1104,6 +1495,15 @@ func getInvoices(client *mongo.Client) http.HandlerFunc {
 			items = append(items, item)
 		}
 
+		// ?expand=customer adds the live customer record alongside the billing snapshot
+		if wantsExpand(r, "customer") {
+			err = expandCustomers(client, items)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
 		// Send the list of items as a JSON response
 		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(items)
@@ -1120,7 +1520,7 @@ func getPayments(client *mongo.Client) http.HandlerFunc {
 		// Get all items from the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("payments")
 		findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}) 
-		cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{}), findOptions)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1155,7 +1555,7 @@ func getCustomers(client *mongo.Client) http.HandlerFunc {
 		// Get all items from the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("customer")
 		findOptions := options.Find().SetSort(bson.D{{Key: "name", Value: 1}}) 
-		cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{}), findOptions)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1189,7 +1589,7 @@ func getDisabledItems(client *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get all items from the "items" collection in MongoDB
 		collection := client.Database(Database).Collection("products")
-		cursor, err := collection.Find(context.Background(), bson.M{"status": "disabled"})
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{"status": "disabled"}))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1233,7 +1633,7 @@ func getItem(client *mongo.Client) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		cursor, err := collection.Find(context.Background(), bson.M{"_id": oid})
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{"_id": oid}))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1252,7 +1652,10 @@ func getItem(client *mongo.Client) http.HandlerFunc {
 			items = append(items, item)
 		}
 
-		// Send the list of items as a JSON response
+		// Send the list of items as a JSON response, with the ETag to edit it
+		if len(items) == 1 {
+			setETag(w, items[0].Version)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(items)
 		if err != nil {
@@ -1277,7 +1680,7 @@ func getInvoice(client *mongo.Client) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		cursor, err := collection.Find(context.Background(), bson.M{"_id": oid})
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{"_id": oid}))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1296,7 +1699,19 @@ func getInvoice(client *mongo.Client) http.HandlerFunc {
 			items = append(items, item)
 		}
 
-		// Send the list of items as a JSON response
+		// ?expand=customer adds the live customer record alongside the billing snapshot
+		if wantsExpand(r, "customer") {
+			err = expandCustomers(client, items)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Send the list of items as a JSON response, with the ETag to edit it
+		if len(items) == 1 {
+			setETag(w, items[0].Version)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(items)
 		if err != nil {
@@ -1321,7 +1736,7 @@ func getCustomer(client *mongo.Client) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		cursor, err := collection.Find(context.Background(), bson.M{"_id": oid})
+		cursor, err := collection.Find(context.Background(), notDeleted(r, bson.M{"_id": oid}))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1340,7 +1755,10 @@ func getCustomer(client *mongo.Client) http.HandlerFunc {
 			items = append(items, item)
 		}
 
-		// Send the list of items as a JSON response
+		// Send the list of items as a JSON response, with the ETag to edit it
+		if len(items) == 1 {
+			setETag(w, items[0].Version)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(items)
 		if err != nil {
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is one versioned change to the database. Up should be safe to run again if it was
+// interrupted before being recorded. Down undoes it, and is nil when that is not possible.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(*mongo.Client) error
+	Down    func(*mongo.Client) error
+}
+
+// AppliedMigration is the record of a migration in schema_migrations
+type AppliedMigration struct {
+	Version   int       `bson:"version" json:"version"`
+	Name      string    `bson:"name" json:"name"`
+	AppliedAt time.Time `bson:"appliedAt" json:"appliedAt"`
+}
+
+var ErrIrreversibleMigration = errors.New("migration cannot be reverted")
+
+// migrations in the order they are applied. Add new ones at the end with the next version and
+// never renumber or edit one that has shipped.
+var migrations = []Migration{
+	indexMigration(1, "customer-number-unique", "customer", "number_1",
+		mongo.IndexModel{Keys: bson.M{"number": 1}, Options: options.Index().SetUnique(true)}),
+	// Sparse so invoices created before numbering are skipped
+	indexMigration(2, "invoice-number-unique", "invoices", "number_1",
+		mongo.IndexModel{Keys: bson.M{"number": 1}, Options: options.Index().SetUnique(true).SetSparse(true)}),
+	// For listing one customer's invoices and payments, newest first
+	indexMigration(3, "invoice-customer-timestamp", "invoices", "custId_1_timestamp_-1",
+		mongo.IndexModel{Keys: bson.D{{Key: "custId", Value: 1}, {Key: "timestamp", Value: -1}}}),
+	indexMigration(4, "payment-customer-timestamp", "payments", "customerid_1_timestamp_-1",
+		mongo.IndexModel{Keys: bson.D{{Key: "customerid", Value: 1}, {Key: "timestamp", Value: -1}}}),
+	// Items and variants without a SKU are skipped
+	indexMigration(5, "item-sku-unique", "products", "sku_1",
+		mongo.IndexModel{Keys: bson.M{"sku": 1}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"sku": bson.M{"$exists": true}})}),
+	indexMigration(6, "variant-sku-unique", "products", "variants.sku_1",
+		mongo.IndexModel{Keys: bson.M{"variants.sku": 1}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"variants.sku": bson.M{"$exists": true}})}),
+	// For looking up the price in effect on a date
+	indexMigration(7, "price-history", "prices", "itemId_1_variantSku_1_effectiveFrom_-1",
+		mongo.IndexModel{Keys: bson.D{{Key: "itemId", Value: 1}, {Key: "variantSku", Value: 1}, {Key: "effectiveFrom", Value: -1}}}),
+	indexMigration(8, "coupon-code-unique", "coupons", "code_1",
+		mongo.IndexModel{Keys: bson.M{"code": 1}, Options: options.Index().SetUnique(true)}),
+	// One agreed price per customer and item or variant
+	indexMigration(9, "customer-price-unique", "customerprices", "custId_1_itemId_1_variantSku_1",
+		mongo.IndexModel{Keys: bson.D{{Key: "custId", Value: 1}, {Key: "itemId", Value: 1}, {Key: "variantSku", Value: 1}}, Options: options.Index().SetUnique(true)}),
+	// Category names are unique within the same parent
+	indexMigration(10, "category-name-unique", "categories", "parentId_1_name_1",
+		mongo.IndexModel{Keys: bson.D{{Key: "parentId", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)}),
+	{
+		Version: 11,
+		Name:    "invoice-customer-ids",
+		Up: func(client *mongo.Client) error {
+			migrated, err := migrateInvoiceCustomers(client)
+			log.Println("Moved", migrated, "invoices to customer ids with billing snapshots")
+			return err
+		},
+	},
+	{
+		Version: 12,
+		Name:    "item-types-to-categories",
+		Up: func(client *mongo.Client) error {
+			migrated, err := migrateItemTypes(client)
+			log.Println("Moved", migrated, "items from types to categories")
+			return err
+		},
+	},
+	// Phone numbers are unique across all of a customer's numbers rather than the primary one
+	{
+		Version: 13,
+		Name:    "customer-numbers-unique",
+		Up: func(client *mongo.Client) error {
+			indexes := client.Database(Database).Collection("customer").Indexes()
+			_, err := indexes.DropOne(context.Background(), "number_1")
+			var cmdErr mongo.CommandError
+			if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == 27) {
+				return err
+			}
+			_, err = indexes.CreateOne(context.Background(), mongo.IndexModel{
+				Keys:    bson.M{"numbers": 1},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"numbers": bson.M{"$type": "string"}}),
+			})
+			return err
+		},
+		Down: func(client *mongo.Client) error {
+			indexes := client.Database(Database).Collection("customer").Indexes()
+			_, err := indexes.DropOne(context.Background(), "numbers_1")
+			if err != nil {
+				return err
+			}
+			_, err = indexes.CreateOne(context.Background(), mongo.IndexModel{Keys: bson.M{"number": 1}, Options: options.Index().SetUnique(true)})
+			return err
+		},
+	},
+	{
+		Version: 14,
+		Name:    "customer-phone-strings",
+		Up:      migratePhoneNumbers,
+	},
+	// Statements start from zero, so balances their entries do not explain get an opening entry
+	{
+		Version: 15,
+		Name:    "customer-opening-balances",
+		Up: func(client *mongo.Client) error {
+			recorded, err := recordOpeningBalances(client)
+			log.Println("Recorded opening balances for", recorded, "customers")
+			return err
+		},
+		Down: func(client *mongo.Client) error {
+			_, err := client.Database(Database).Collection("adjustments").DeleteMany(context.Background(), bson.M{"type": "opening_balance"})
+			return err
+		},
+	},
+	// Stored idempotency keys expire after the retention window
+	{
+		Version: 16,
+		Name:    "idempotency-key-expiry",
+		Up:      ensureIdempotencyIndex,
+		Down: func(client *mongo.Client) error {
+			_, err := client.Database(Database).Collection("idempotencykeys").Indexes().DropOne(context.Background(), "createdAt_ttl")
+			return err
+		},
+	},
+	// A Stripe PaymentIntent is recorded as one payment at most; other payments have an empty stripeid
+	indexMigration(17, "payment-stripeid-unique", "payments", "stripeid_1",
+		mongo.IndexModel{Keys: bson.M{"stripeid": 1}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"stripeid": bson.M{"$gt": ""}})}),
+	// Archiving moved out of status, which enabling and disabling overwrite
+	{
+		Version: 18,
+		Name:    "archived-at",
+		Up: func(client *mongo.Client) error {
+			for _, collection := range []string{"customer", "products"} {
+				update := bson.M{"$set": bson.M{"archivedAt": time.Now(), "status": "disabled"}}
+				_, err := client.Database(Database).Collection(collection).UpdateMany(context.Background(), bson.M{"status": "archived"}, update)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// indexMigration creates an index on the way up and drops it by name on the way down
+func indexMigration(version int, name, collection, indexName string, model mongo.IndexModel) Migration {
+	return Migration{
+		Version: version,
+		Name:    name,
+		Up: func(client *mongo.Client) error {
+			_, err := client.Database(Database).Collection(collection).Indexes().CreateOne(context.Background(), model)
+			return err
+		},
+		Down: func(client *mongo.Client) error {
+			_, err := client.Database(Database).Collection(collection).Indexes().DropOne(context.Background(), indexName)
+			return err
+		},
+	}
+}
+
+func schemaMigrations(client *mongo.Client) *mongo.Collection {
+	return client.Database(Database).Collection("schema_migrations")
+}
+
+// appliedMigrations returns the recorded migrations by version
+func appliedMigrations(client *mongo.Client) (map[int]AppliedMigration, error) {
+	cursor, err := schemaMigrations(client).Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []AppliedMigration
+	err = cursor.All(context.Background(), &records)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]AppliedMigration{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// migrateUp applies every pending migration in order and returns how many were applied. It stops
+// at the first one that fails.
+func migrateUp(client *mongo.Client) (int, error) {
+	_, err := schemaMigrations(client).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"version": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(client)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err = migration.Up(client)
+		if err != nil {
+			return count, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		record := AppliedMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+		_, err = schemaMigrations(client).InsertOne(context.Background(), record)
+		// Another instance starting at the same time may have recorded it first
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return count, err
+		}
+		log.Println("Applied migration", migration.Version, migration.Name)
+		count++
+	}
+	return count, nil
+}
+
+// migrateDown reverts the last steps applied migrations, newest first
+func migrateDown(client *mongo.Client, steps int) (int, error) {
+	applied, err := appliedMigrations(client)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return count, fmt.Errorf("%w: %d %s", ErrIrreversibleMigration, migration.Version, migration.Name)
+		}
+		err = migration.Down(client)
+		if err != nil {
+			return count, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = schemaMigrations(client).DeleteOne(context.Background(), bson.M{"version": migration.Version})
+		if err != nil {
+			return count, err
+		}
+		log.Println("Reverted migration", migration.Version, migration.Name)
+		count++
+	}
+	return count, nil
+}
+
+// printMigrationStatus lists every migration with when it was applied, or pending
+func printMigrationStatus(client *mongo.Client) error {
+	applied, err := appliedMigrations(client)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		status := "pending"
+		if record, ok := applied[migration.Version]; ok {
+			status = "applied " + record.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%4d  %-30s %s\n", migration.Version, migration.Name, status)
+	}
+	return nil
+}
+
+// migrateCommand runs `app migrate up|down [steps]|status` against MONGO_URL and returns the
+// exit code
+func migrateCommand(args []string) int {
+	mongoURL, err := getEnv("MONGO_URL")
+	if err != nil {
+		return 1
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURL))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		_, err = migrateUp(client)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Println("steps must be a positive number")
+				return 2
+			}
+		}
+		_, err = migrateDown(client, steps)
+	case "status":
+		err = printMigrationStatus(client)
+	default:
+		log.Println("usage: migrate up|down [steps]|status")
+		return 2
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
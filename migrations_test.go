@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Versions are recorded in schema_migrations, so they must count up from 1 without gaps or repeats
+func TestMigrationsAreNumberedInOrder(t *testing.T) {
+	names := map[string]bool{}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if migration.Name == "" {
+			t.Errorf("migration %d has no name", migration.Version)
+		}
+		if names[migration.Name] {
+			t.Errorf("migration name %q is used more than once", migration.Name)
+		}
+		names[migration.Name] = true
+		if migration.Up == nil {
+			t.Errorf("migration %d %q has no Up", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestIndexMigration(t *testing.T) {
+	migration := indexMigration(42, "widget-code", "widgets", "code_1", mongo.IndexModel{Keys: bson.M{"code": 1}})
+	if migration.Version != 42 || migration.Name != "widget-code" {
+		t.Errorf("indexMigration() = %d %q, want 42 widget-code", migration.Version, migration.Name)
+	}
+	if migration.Up == nil || migration.Down == nil {
+		t.Error("index migrations should be reversible")
+	}
+}
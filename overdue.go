@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Adjustment is a ledger entry that changes a customer's balance outside of invoices and
+// payments, such as a late fee, with the reason it was made
+type Adjustment struct {
+	Number            string             `json:"number"`
+	Type              string             `json:"type"`
+	CustomerID        primitive.ObjectID `bson:"custId" json:"custId"`
+	InvoiceID         string             `bson:"invoiceId,omitempty" json:"invoiceId,omitempty"`
+	Amount            float64            `json:"amount"`
+	Reason            string             `json:"reason"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type AdjustmentGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Number            string             `json:"number"`
+	Type              string             `json:"type"`
+	CustomerID        primitive.ObjectID `bson:"custId" json:"custId"`
+	InvoiceID         string             `bson:"invoiceId,omitempty" json:"invoiceId,omitempty"`
+	Amount            float64            `json:"amount"`
+	Reason            string             `json:"reason"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// AgingRow is one customer's outstanding balance split by how long it has been past due
+type AgingRow struct {
+	CustomerID primitive.ObjectID `json:"custId"`
+	Name       string             `json:"name"`
+	Current    float64            `json:"current"`
+	Days1To30  float64            `json:"1-30"`
+	Days31To60 float64            `json:"31-60"`
+	Days61To90 float64            `json:"61-90"`
+	Over90     float64            `json:"90+"`
+	Total      float64            `json:"total"`
+}
+
+// systemActor is recorded as the actor for changes made by background jobs
+const systemActor = "system"
+
+// envFloat reads a number from the environment, falling back when it is unset or invalid
+func envFloat(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// invoiceDueDate works out when an invoice is due: on the customer's monthly due day following the
+// invoice date, or INVOICE_DUE_DAYS (default 30) after it for customers without a due day
+func invoiceDueDate(issued time.Time, dueDay int64) time.Time {
+	if dueDay < 1 || dueDay > 31 {
+		return issued.AddDate(0, 0, int(envFloat("INVOICE_DUE_DAYS", 30)))
+	}
+	for months := 0; ; months++ {
+		first := time.Date(issued.Year(), issued.Month()+time.Month(months), 1, 0, 0, 0, 0, issued.Location())
+		day := int(dueDay)
+		if last := first.AddDate(0, 1, -1).Day(); day > last {
+			day = last
+		}
+		// Due at the end of the due day
+		due := first.AddDate(0, 0, day).Add(-time.Nanosecond)
+		if due.After(issued) {
+			return due
+		}
+	}
+}
+
+// customerDueDate works out the due date of an invoice issued now to the given customer
+func customerDueDate(client *mongo.Client, custID primitive.ObjectID, issued time.Time) (time.Time, error) {
+	var customer CustomerGet
+	err := client.Database(Database).Collection("customer").FindOne(context.Background(), bson.M{"_id": custID}).Decode(&customer)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return time.Time{}, err
+	}
+	return invoiceDueDate(issued, customer.DueDay), nil
+}
+
+// markOverdueInvoices moves invoices that are still owed past their due date to overdue and posts
+// late fees on them. Invoices from before due dates were kept get one worked out first. An invoice
+// that fails is logged and skipped so it does not hold up the rest; the failures are returned
+// together at the end.
+func markOverdueInvoices(client *mongo.Client) error {
+	collection := client.Database(Database).Collection("invoices")
+	now := time.Now()
+
+	filter := bson.M{"status": bson.M{"$nin": bson.A{InvoiceDraft, InvoiceVoid}}, "duedate": bson.M{"$exists": false}}
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	var undated []InvoiceGet
+	err = cursor.All(context.Background(), &undated)
+	if err != nil {
+		return err
+	}
+	var failed []error
+	skip := func(invoice InvoiceGet, err error) {
+		log.Println("overdue:", invoice.Number, err.Error())
+		failed = append(failed, fmt.Errorf("invoice %s: %w", invoice.Number, err))
+	}
+	for _, invoice := range undated {
+		dueDate, err := customerDueDate(client, invoice.CustomerID, invoice.Date)
+		if err != nil {
+			skip(invoice, err)
+			continue
+		}
+		_, err = collection.UpdateOne(context.Background(), bson.M{"_id": invoice.ID}, bson.M{"$set": bson.M{"duedate": dueDate}})
+		if err != nil {
+			skip(invoice, err)
+		}
+	}
+
+	filter = bson.M{"status": bson.M{"$nin": bson.A{InvoiceDraft, InvoicePaid, InvoiceVoid}}, "duedate": bson.M{"$lt": now}}
+	cursor, err = collection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	var pastDue []InvoiceGet
+	err = cursor.All(context.Background(), &pastDue)
+	if err != nil {
+		return err
+	}
+	for _, invoice := range pastDue {
+		if invoiceDue(invoice) <= 0 {
+			continue
+		}
+		if invoice.Status != InvoiceOverdue {
+			_, err = transitionInvoice(client, invoice.ID, InvoiceOverdue, systemActor)
+			var transitionErr *TransitionError
+			if errors.As(err, &transitionErr) {
+				log.Println("overdue:", invoice.Number, err.Error())
+				continue
+			}
+			if err != nil {
+				skip(invoice, err)
+				continue
+			}
+		}
+		err = postLateFee(client, invoice, now)
+		if err != nil {
+			skip(invoice, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// postLateFee charges the configured late fee on an overdue invoice once the grace period is over.
+// The fee is LATE_FEE_FIXED plus LATE_FEE_PERCENT of what is outstanding, charged once per invoice
+// LATE_FEE_GRACE_DAYS after the due date. With neither set no fees are charged.
+func postLateFee(client *mongo.Client, invoice InvoiceGet, now time.Time) error {
+	fixed := envFloat("LATE_FEE_FIXED", 0)
+	percent := envFloat("LATE_FEE_PERCENT", 0)
+	grace := time.Duration(envFloat("LATE_FEE_GRACE_DAYS", 0)) * 24 * time.Hour
+	if (fixed == 0 && percent == 0) || now.Before(invoice.DueDate.Add(grace)) {
+		return nil
+	}
+	due := invoiceDue(invoice)
+	fee := roundMoney(fixed + due*percent/100)
+	if fee <= 0 {
+		return nil
+	}
+
+	// Claim the invoice first so a fee is never charged twice
+	collection := client.Database(Database).Collection("invoices")
+	result, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": invoice.ID, "latefeeat": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"latefeeat": now}})
+	if err != nil || result.ModifiedCount == 0 {
+		return err
+	}
+
+	seq, err := nextSequence(client, "adjustment")
+	if err != nil {
+		return err
+	}
+	number := fmt.Sprintf("ADJ-%06d", seq)
+	err = postInvoiceAmount(client, invoice.ID.Hex(), "latefees", fee, "late_fee", number, systemActor)
+	if err != nil {
+		return err
+	}
+	_, err = adjustBalance(client, invoice.CustomerID, fee)
+	if err != nil {
+		return err
+	}
+	days := int(now.Sub(invoice.DueDate).Hours() / 24)
+	adjustment := Adjustment{
+		Number:            number,
+		Type:              "late_fee",
+		CustomerID:        invoice.CustomerID,
+		InvoiceID:         invoice.ID.Hex(),
+		Amount:            fee,
+		Reason:            fmt.Sprintf("Late fee on invoice %s: %s outstanding %d days after the due date %s", invoice.Number, formatMoney(due), days, invoice.DueDate.Format("2006-01-02")),
+		Actor:             systemActor,
+		CapturedTimestamp: now,
+	}
+	_, err = client.Database(Database).Collection("adjustments").InsertOne(context.Background(), adjustment)
+	return err
+}
+
+// getAdjustments lists balance adjustments, optionally for one customer (?custId=), newest first
+func getAdjustments(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := bson.M{}
+		if custID := r.URL.Query().Get("custId"); custID != "" {
+			oid, err := primitive.ObjectIDFromHex(custID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter["custId"] = oid
+		}
+
+		collection := client.Database(Database).Collection("adjustments")
+		findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+		cursor, err := collection.Find(context.Background(), filter, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []AdjustmentGet
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getAgingReport buckets each customer's outstanding invoices by days past due, as JSON or CSV
+// (?format=csv). Customers owing the most come first.
+func getAgingReport(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := client.Database(Database).Collection("invoices")
+		filter := bson.M{"status": bson.M{"$nin": bson.A{InvoiceDraft, InvoicePaid, InvoiceVoid}}}
+		cursor, err := collection.Find(context.Background(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var invoices []InvoiceGet
+		err = cursor.All(context.Background(), &invoices)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		rows := map[primitive.ObjectID]*AgingRow{}
+		for _, invoice := range invoices {
+			due := invoiceDue(invoice)
+			if due <= 0 {
+				continue
+			}
+			row, ok := rows[invoice.CustomerID]
+			if !ok {
+				row = &AgingRow{CustomerID: invoice.CustomerID, Name: invoice.Billing.Name}
+				rows[invoice.CustomerID] = row
+			}
+			// Due dates of older invoices are filled in by the overdue job; until then use the default terms
+			dueDate := invoice.DueDate
+			if dueDate.IsZero() {
+				dueDate = invoiceDueDate(invoice.Date, 0)
+			}
+			days := now.Sub(dueDate).Hours() / 24
+			switch {
+			case days <= 0:
+				row.Current = roundMoney(row.Current + due)
+			case days <= 30:
+				row.Days1To30 = roundMoney(row.Days1To30 + due)
+			case days <= 60:
+				row.Days31To60 = roundMoney(row.Days31To60 + due)
+			case days <= 90:
+				row.Days61To90 = roundMoney(row.Days61To90 + due)
+			default:
+				row.Over90 = roundMoney(row.Over90 + due)
+			}
+			row.Total = roundMoney(row.Total + due)
+		}
+
+		var items []AgingRow
+		totals := AgingRow{Name: "total"}
+		for _, row := range rows {
+			items = append(items, *row)
+			totals.Current = roundMoney(totals.Current + row.Current)
+			totals.Days1To30 = roundMoney(totals.Days1To30 + row.Days1To30)
+			totals.Days31To60 = roundMoney(totals.Days31To60 + row.Days31To60)
+			totals.Days61To90 = roundMoney(totals.Days61To90 + row.Days61To90)
+			totals.Over90 = roundMoney(totals.Over90 + row.Over90)
+			totals.Total = roundMoney(totals.Total + row.Total)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Total > items[j].Total })
+
+		if r.URL.Query().Get("format") == "csv" {
+			var csvRows [][]string
+			for _, row := range append(items, totals) {
+				custID := ""
+				if !row.CustomerID.IsZero() {
+					custID = row.CustomerID.Hex()
+				}
+				csvRows = append(csvRows, []string{custID, row.Name, formatMoney(row.Current), formatMoney(row.Days1To30), formatMoney(row.Days31To60), formatMoney(row.Days61To90), formatMoney(row.Over90), formatMoney(row.Total)})
+			}
+			writeCSV(w, "aging.csv", []string{"custId", "name", "current", "1-30", "31-60", "61-90", "90+", "total"}, csvRows)
+			return
+		}
+
+		report := map[string]interface{}{"asOf": now, "customers": items, "totals": totals}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvFloat(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  float64
+	}{
+		{name: "unset", value: "", want: 2},
+		{name: "number", value: "12.5", want: 12.5},
+		{name: "zero", value: "0", want: 0},
+		{name: "negative", value: "-1", want: 2},
+		{name: "not a number", value: "ten", want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LATE_FEE_PERCENT", tt.value)
+			if got := envFloat("LATE_FEE_PERCENT", 2); got != tt.want {
+				t.Errorf("envFloat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvoiceDueDate(t *testing.T) {
+	endOfDay := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 23, 59, 59, int(time.Second-time.Nanosecond), time.UTC)
+	}
+	tests := []struct {
+		name    string
+		issued  time.Time
+		dueDay  int64
+		dueDays string
+		want    time.Time
+	}{
+		{name: "due day later this month", issued: time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC), dueDay: 15, want: endOfDay(2024, 3, 15)},
+		{name: "due day already passed", issued: time.Date(2024, 3, 20, 10, 0, 0, 0, time.UTC), dueDay: 15, want: endOfDay(2024, 4, 15)},
+		{name: "issued on the due day", issued: time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC), dueDay: 31, want: endOfDay(2024, 1, 31)},
+		{name: "due day past the end of a short month", issued: time.Date(2024, 2, 10, 10, 0, 0, 0, time.UTC), dueDay: 31, want: endOfDay(2024, 2, 29)},
+		{name: "into the next year", issued: time.Date(2024, 12, 20, 10, 0, 0, 0, time.UTC), dueDay: 5, want: endOfDay(2025, 1, 5)},
+		{name: "no due day", issued: time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC), want: time.Date(2024, 4, 9, 10, 0, 0, 0, time.UTC)},
+		{name: "no due day with INVOICE_DUE_DAYS", issued: time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC), dueDays: "14", want: time.Date(2024, 3, 24, 10, 0, 0, 0, time.UTC)},
+		{name: "due day out of range", issued: time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC), dueDay: 40, want: time.Date(2024, 4, 9, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("INVOICE_DUE_DAYS", tt.dueDays)
+			if got := invoiceDueDate(tt.issued, tt.dueDay); !got.Equal(tt.want) {
+				t.Errorf("invoiceDueDate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Fields that PATCH refuses to change, by their JSON names. Balances, amounts and history only move
+// through payments, invoices and the other routes that record why.
+var (
+	itemReadOnly     = []string{"id", "stock", "version", "archivedAt", "timestamp", "CapturedTimestamp"}
+	customerReadOnly = []string{"id", "balance", "credit", "version", "archivedAt", "timestamp", "CapturedTimestamp"}
+	invoiceReadOnly  = []string{"id", "number", "status", "custId", "customer", "billing", "coupon", "couponDiscount",
+		"discountTotal", "subtotal", "taxTotal", "taxes", "total", "amountPaid", "credited", "lateFees", "amountDue",
+		"dueDate", "history", "version", "timestamp", "Date"}
+	paymentReadOnly = []string{"id", "allocations", "credit", "refunded", "version", "timestamp", "CapturedTimestamp"}
+)
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to a decoded JSON document
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		doc = map[string]interface{}{}
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(doc, name)
+		} else {
+			doc[name] = mergePatch(doc[name], value)
+		}
+	}
+	return doc
+}
+
+// patchHandler changes only the fields given in a merge patch. The patch is applied to the record
+// as GET returns it and the result is saved through the PUT handler, so the same validation and
+// bookkeeping apply. If-Match is required as for PUT.
+func patchHandler(client *mongo.Client, collection string, newDoc func() interface{}, readOnly []string, put http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeVersionError(w, err)
+			return
+		}
+
+		var patch map[string]interface{}
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			http.Error(w, "body must be a JSON merge patch object", http.StatusBadRequest)
+			return
+		}
+		for _, field := range readOnly {
+			if _, ok := patch[field]; ok {
+				http.Error(w, field+" is read-only", http.StatusBadRequest)
+				return
+			}
+		}
+
+		current := newDoc()
+		err = client.Database(Database).Collection(collection).FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(current)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encoded, err := json.Marshal(current)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var doc map[string]interface{}
+		err = json.Unmarshal(encoded, &doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if currentVersion, _ := doc["version"].(float64); int64(currentVersion) != version {
+			writeStale(w, current, int64(currentVersion))
+			return
+		}
+
+		merged, err := json.Marshal(mergePatch(doc, patch))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		replace := r.Clone(r.Context())
+		replace.Method = http.MethodPut
+		replace.Body = io.NopCloser(bytes.NewReader(merged))
+		replace.ContentLength = int64(len(merged))
+		put(w, replace)
+	}
+}
+
+func patchItem(client *mongo.Client) http.HandlerFunc {
+	return patchHandler(client, "products", func() interface{} { return &ItemGet{} }, itemReadOnly, editItem(client))
+}
+
+func patchCustomer(client *mongo.Client) http.HandlerFunc {
+	return patchHandler(client, "customer", func() interface{} { return &CustomerGet{} }, customerReadOnly, editCustomer(client))
+}
+
+func patchInvoice(client *mongo.Client) http.HandlerFunc {
+	return patchHandler(client, "invoices", func() interface{} { return &InvoiceGet{} }, invoiceReadOnly, editInvoice(client))
+}
+
+func patchPayment(client *mongo.Client) http.HandlerFunc {
+	return patchHandler(client, "payments", func() interface{} { return &PaymentCaptureGet{} }, paymentReadOnly, editPayment(client))
+}
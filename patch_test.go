@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Cases from the examples in RFC 7386
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{target: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{target: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{target: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{target: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{target: `{"a":["b"]}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{target: `{"a":"c"}`, patch: `{"a":["b"]}`, want: `{"a":["b"]}`},
+		{target: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{target: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, want: `{"a":[1]}`},
+		{target: `["a","b"]`, patch: `["c","d"]`, want: `["c","d"]`},
+		{target: `{"a":"b"}`, patch: `["c"]`, want: `["c"]`},
+		{target: `{"a":"foo"}`, patch: `null`, want: `null`},
+		{target: `{"a":"foo"}`, patch: `"bar"`, want: `"bar"`},
+		{target: `{"e":null}`, patch: `{"a":1}`, want: `{"e":null,"a":1}`},
+		{target: `[1,2]`, patch: `{"a":"b","c":null}`, want: `{"a":"b"}`},
+		{target: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.patch, func(t *testing.T) {
+			var target, patch, want interface{}
+			for _, doc := range []struct {
+				raw string
+				out *interface{}
+			}{{tt.target, &target}, {tt.patch, &patch}, {tt.want, &want}} {
+				if err := json.Unmarshal([]byte(doc.raw), doc.out); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergePatch() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// capturePayment records a payment, takes it off the customer balance, allocates it to invoices,
+// keeps any remainder as customer credit and issues a receipt. It is shared by every route that
+// takes money so they all post payments the same way. The payment is saved as pending first and
+// finishPayment does the rest, so a capture that fails part way can be finished later.
+func capturePayment(client *mongo.Client, item *PaymentCapture, actor string) (primitive.ObjectID, error) {
+	if item.Amount <= 0 {
+		return primitive.NilObjectID, fmt.Errorf("%w: amount must be positive", ErrInvalidPayment)
+	}
+	custOid, err := primitive.ObjectIDFromHex(item.CustomerID)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %s", ErrInvalidPayment, err.Error())
+	}
+
+	allocations, err := planAllocations(client, custOid, item.Amount, item.Allocations)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	item.Allocations = allocations
+	item.Credit = roundMoney(item.Amount - allocatedTotal(allocations))
+	item.Refunded = 0
+	item.Pending = true
+	if item.CapturedTimestamp.IsZero() {
+		item.CapturedTimestamp = time.Now()
+	}
+
+	collection := client.Database(Database).Collection("payments")
+	result, err := collection.InsertOne(context.Background(), item)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	paymentID := result.InsertedID.(primitive.ObjectID)
+	return paymentID, finishPayment(client, paymentID, actor)
+}
+
+// finishPayment carries out the steps of a pending payment that are not done yet. Each step is
+// recorded on the payment once it is done, so running this again after a failure picks up where
+// it stopped rather than posting anything twice.
+func finishPayment(client *mongo.Client, paymentID primitive.ObjectID, actor string) error {
+	collection := client.Database(Database).Collection("payments")
+	var payment PaymentCaptureGet
+	err := collection.FindOne(context.Background(), bson.M{"_id": paymentID}).Decode(&payment)
+	if err != nil {
+		return err
+	}
+	if !payment.Pending {
+		return nil
+	}
+	custOid, err := primitive.ObjectIDFromHex(payment.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	done := map[string]bool{}
+	for _, step := range payment.Steps {
+		done[step] = true
+	}
+	step := func(name string, run func() (bson.M, error)) error {
+		if done[name] {
+			return nil
+		}
+		set, err := run()
+		if err != nil {
+			return err
+		}
+		update := bson.M{"$addToSet": bson.M{"steps": name}}
+		if set != nil {
+			update["$set"] = set
+		}
+		_, err = collection.UpdateOne(context.Background(), bson.M{"_id": paymentID}, update)
+		return err
+	}
+
+	err = step("balance", func() (bson.M, error) {
+		newBalance, err := adjustBalance(client, custOid, -payment.Amount)
+		payment.BalanceAfter = newBalance
+		return bson.M{"balanceafter": newBalance}, err
+	})
+	if err != nil {
+		return err
+	}
+	err = step("credit", func() (bson.M, error) {
+		return nil, adjustCredit(client, custOid, payment.Credit)
+	})
+	if err != nil {
+		return err
+	}
+	for _, allocation := range payment.Allocations {
+		err = step("allocation:"+allocation.InvoiceID, func() (bson.M, error) {
+			return nil, postInvoiceAmount(client, allocation.InvoiceID, "amountpaid", allocation.Amount, "allocation", paymentID.Hex(), actor)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = step("receipt", func() (bson.M, error) {
+		item := PaymentCapture{CustomerID: payment.CustomerID, Amount: payment.Amount, StripeID: payment.StripeID, Mode: payment.Mode, CapturedTimestamp: payment.CapturedTimestamp}
+		return nil, issueReceipt(client, paymentID, item, payment.BalanceAfter)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": paymentID}, bson.M{"$unset": bson.M{"pending": "", "steps": "", "balanceafter": ""}})
+	return err
+}
+
+var ErrInvoiceNotPayable = errors.New("invoice cannot take payments")
+
+// captureInvoicePayment records a payment against one invoice. The payment goes to that invoice
+// up to what it still owes and the rest is kept as credit. When no customer is given the
+// invoice's customer is used. An invoice that owes nothing is refused rather than letting the
+// payment spread over the customer's other invoices.
+func captureInvoicePayment(client *mongo.Client, invoiceOid primitive.ObjectID, item *PaymentCapture, actor string) (primitive.ObjectID, error) {
+	var invoice InvoiceGet
+	err := client.Database(Database).Collection("invoices").FindOne(context.Background(), bson.M{"_id": invoiceOid}).Decode(&invoice)
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if invoice.Status == InvoiceDraft || invoice.Status == InvoiceVoid {
+		return primitive.NilObjectID, fmt.Errorf("%w: it is %s", ErrInvoiceNotPayable, invoice.Status)
+	}
+
+	if item.CustomerID == "" {
+		item.CustomerID = invoice.CustomerID.Hex()
+	}
+	due := invoiceDue(invoice)
+	if due <= 0 {
+		return primitive.NilObjectID, fmt.Errorf("%w: it has nothing left to pay", ErrInvoiceNotPayable)
+	}
+	item.Allocations = []PaymentAllocation{{InvoiceID: invoiceOid.Hex(), Amount: math.Min(item.Amount, due)}}
+	return capturePayment(client, item, actor)
+}
+
+// paymentErrorStatus maps the errors of capturePayment and captureInvoicePayment to HTTP statuses
+func paymentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidPayment):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInvoiceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvoiceNotPayable):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// getPayment returns one payment with the ETag to edit it
+func getPayment(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var payment PaymentCaptureGet
+		err = client.Database(Database).Collection("payments").FindOne(context.Background(), notDeleted(r, bson.M{"_id": oid})).Decode(&payment)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "payment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setETag(w, payment.Version)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(payment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
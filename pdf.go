@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	pdfPageWidth    = 595
+	pdfPageHeight   = 842
+	pdfMargin       = 50
+	pdfLineHeight   = 14
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// pdfEscape escapes a string for use inside a PDF literal string.
+// Characters outside printable ASCII are replaced since the standard fonts only cover Latin-1.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// renderPDF lays out a title and plain text lines on as many A4 pages as needed.
+// It writes the PDF structure by hand so no extra dependency is required.
+func renderPDF(title string, lines []string) []byte {
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage-2 {
+		pages = append(pages, lines[:pdfLinesPerPage-2])
+		lines = lines[pdfLinesPerPage-2:]
+	}
+	pages = append(pages, lines)
+
+	// Object 1 is the catalog, 2 the page tree, 3 the font; each page then uses two objects.
+	var objects []string
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
+	}
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+	objects = append(objects, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	objects = append(objects, "<< /Type /Font /Subtype /Type1 /Name /F1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+
+	for i, pageLines := range pages {
+		var content bytes.Buffer
+		content.WriteString("BT\n")
+		y := pdfPageHeight - pdfMargin
+		content.WriteString(fmt.Sprintf("/F1 14 Tf\n%d %d Td\n(%s) Tj\n", pdfMargin, y, pdfEscape(title)))
+		content.WriteString(fmt.Sprintf("/F1 10 Tf\n0 -%d Td\n", 2*pdfLineHeight))
+		for _, line := range pageLines {
+			content.WriteString(fmt.Sprintf("(%s) Tj\n0 -%d Td\n", pdfEscape(line), pdfLineHeight))
+		}
+		content.WriteString(fmt.Sprintf("ET\nBT\n/F1 8 Tf\n%d %d Td\n(Page %d of %d) Tj\nET\n", pdfMargin, pdfMargin/2, i+1, len(pages)))
+
+		objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, 5+i*2))
+		objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		out.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", i+1, obj))
+	}
+	xref := out.Len()
+	out.WriteString(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(objects)+1))
+	for _, off := range offsets {
+		out.WriteString(fmt.Sprintf("%010d 00000 n \n", off))
+	}
+	out.WriteString(fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref))
+	return out.Bytes()
+}
+
+// wantsPDF reports whether the client asked for a PDF via ?format=pdf or the Accept header.
+func wantsPDF(format, accept string) bool {
+	return format == "pdf" || strings.Contains(accept, "application/pdf")
+}
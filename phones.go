@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PhoneNumber is a phone number in E.164 form, e.g. +919876543210, optionally followed by an
+// extension as ;ext=12. Older clients send numbers as JSON numbers, which are accepted too.
+type PhoneNumber string
+
+func (p *PhoneNumber) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+		*p = ""
+	case string:
+		*p = PhoneNumber(v)
+	case float64:
+		*p = PhoneNumber(fmt.Sprintf("%.0f", v))
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidPhone, data)
+	}
+	return nil
+}
+
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// phoneCountryCode is the calling code assumed for numbers entered without one, PHONE_COUNTRY_CODE
+// (default 91)
+func phoneCountryCode() string {
+	code := strings.TrimPrefix(os.Getenv("PHONE_COUNTRY_CODE"), "+")
+	if code == "" {
+		return "91"
+	}
+	return code
+}
+
+// normalizePhone turns a number as typed (spaces, dashes, brackets, a leading 00 or trunk 0, an
+// extension after x or ext) into E.164
+func normalizePhone(raw string) (PhoneNumber, error) {
+	number := strings.ToLower(strings.TrimSpace(raw))
+	extension := ""
+	for _, marker := range []string{";ext=", "ext.", "ext", "x", "#"} {
+		if i := strings.Index(number, marker); i > 0 {
+			number, extension = number[:i], strings.TrimSpace(number[i+len(marker):])
+			break
+		}
+	}
+
+	international := strings.HasPrefix(number, "+")
+	var digits strings.Builder
+	for _, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' || r == ' ' || r == '-' || r == '.' || r == '(' || r == ')' || r == '/':
+		default:
+			return "", fmt.Errorf("%w: %s", ErrInvalidPhone, raw)
+		}
+	}
+	national := digits.String()
+	switch {
+	case international:
+	case strings.HasPrefix(national, "00"):
+		national = national[2:]
+	// Numbers saved as floats lost their +, but longer than a national number they already have the code
+	case strings.HasPrefix(national, phoneCountryCode()) && len(national) > 10:
+	default:
+		national = phoneCountryCode() + strings.TrimLeft(national, "0")
+	}
+	// E.164 allows at most 15 digits and no country code starts with 0
+	if len(national) < 8 || len(national) > 15 || national[0] == '0' {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPhone, raw)
+	}
+
+	phone := "+" + national
+	if extension != "" {
+		for _, r := range extension {
+			if r < '0' || r > '9' {
+				return "", fmt.Errorf("%w: %s", ErrInvalidPhone, raw)
+			}
+		}
+		phone += ";ext=" + extension
+	}
+	return PhoneNumber(phone), nil
+}
+
+// normalizePhones normalizes a customer's primary number and other contact numbers, returning the
+// primary and the full list with the primary first and no repeats
+func normalizePhones(primary PhoneNumber, others []PhoneNumber) (PhoneNumber, []PhoneNumber, error) {
+	numbers := []PhoneNumber{}
+	seen := map[PhoneNumber]bool{}
+	for _, raw := range append([]PhoneNumber{primary}, others...) {
+		if strings.TrimSpace(string(raw)) == "" {
+			continue
+		}
+		phone, err := normalizePhone(string(raw))
+		if err != nil {
+			return "", nil, err
+		}
+		if !seen[phone] {
+			seen[phone] = true
+			numbers = append(numbers, phone)
+		}
+	}
+	if len(numbers) == 0 {
+		return "", numbers, nil
+	}
+	return numbers[0], numbers, nil
+}
+
+// phoneConflict looks for another customer already using one of the numbers, and describes it
+func phoneConflict(client *mongo.Client, numbers []PhoneNumber, self primitive.ObjectID) (string, error) {
+	if len(numbers) == 0 {
+		return "", nil
+	}
+	filter := bson.M{"numbers": bson.M{"$in": numbers}, "_id": bson.M{"$ne": self}}
+	var existing CustomerGet
+	err := client.Database(Database).Collection("customer").FindOne(context.Background(), filter).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, phone := range existing.Numbers {
+		for _, number := range numbers {
+			if phone == number {
+				return fmt.Sprintf("phone number %s already belongs to %s (%s)", phone, existing.Name, existing.ID.Hex()), nil
+			}
+		}
+	}
+	return "phone number already belongs to " + existing.Name + " (" + existing.ID.Hex() + ")", nil
+}
+
+// writePhoneConflict answers a duplicate key error on a customer's numbers with a 409 naming the
+// customer who already has the number
+func writePhoneConflict(w http.ResponseWriter, client *mongo.Client, numbers []PhoneNumber, self primitive.ObjectID, err error) {
+	message, lookupErr := phoneConflict(client, numbers, self)
+	if lookupErr != nil || message == "" {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, message, http.StatusConflict)
+}
+
+// migratePhoneNumbers converts customers' numbers stored as floats into E.164 strings and fills in
+// numbers. Ones that cannot be read as a phone number are cleared, and ones that turn out to be
+// another customer's number are kept only as the primary number; both are logged.
+func migratePhoneNumbers(client *mongo.Client) error {
+	collection := client.Database(Database).Collection("customer")
+	filter := bson.M{"$or": bson.A{
+		bson.M{"number": bson.M{"$type": bson.A{"double", "int", "long"}}},
+		bson.M{"numbers": bson.M{"$exists": false}},
+	}}
+	cursor, err := collection.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	var customers []bson.M
+	err = cursor.All(context.Background(), &customers)
+	if err != nil {
+		return err
+	}
+	for _, customer := range customers {
+		raw := ""
+		switch number := customer["number"].(type) {
+		case float64:
+			raw = fmt.Sprintf("%.0f", number)
+		case int32, int64:
+			raw = fmt.Sprintf("%d", number)
+		case string:
+			raw = number
+		}
+		numbers := []PhoneNumber{}
+		phone, err := normalizePhone(raw)
+		if err == nil {
+			numbers = append(numbers, phone)
+		} else if raw != "" && raw != "0" {
+			log.Println("Clearing unreadable phone number", raw, "of customer", customer["_id"])
+		}
+		_, err = collection.UpdateOne(context.Background(), bson.M{"_id": customer["_id"]},
+			bson.M{"$set": bson.M{"number": phone, "numbers": numbers}})
+		if mongo.IsDuplicateKeyError(err) {
+			log.Println("Phone number", phone, "of customer", customer["_id"], "belongs to another customer")
+			_, err = collection.UpdateOne(context.Background(), bson.M{"_id": customer["_id"]},
+				bson.M{"$set": bson.M{"number": phone, "numbers": []PhoneNumber{}}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		countryCode string
+		want        PhoneNumber
+		err         error
+	}{
+		{name: "national with spaces", raw: "98765 43210", want: "+919876543210"},
+		{name: "international with dashes", raw: "+91 98765-43210", want: "+919876543210"},
+		{name: "leading 00", raw: "0091 98765 43210", want: "+919876543210"},
+		{name: "trunk 0", raw: "098765 43210", want: "+919876543210"},
+		{name: "float that lost its plus", raw: "919876543210", want: "+919876543210"},
+		{name: "brackets", raw: "(022) 2345 6789", want: "+912223456789"},
+		{name: "other country", raw: "+44 20 7946 0958", want: "+442079460958"},
+		{name: "configured country code", raw: "020 7946 0958", countryCode: "+44", want: "+442079460958"},
+		{name: "extension after x", raw: "+1 (415) 555-0100 x12", want: "+14155550100;ext=12"},
+		{name: "extension after ext.", raw: "98765 43210 ext. 5", want: "+919876543210;ext=5"},
+		{name: "too short", raw: "12345", err: ErrInvalidPhone},
+		{name: "too long", raw: "+1234567890123456", err: ErrInvalidPhone},
+		{name: "letters", raw: "98765abc", err: ErrInvalidPhone},
+		{name: "country code starting with 0", raw: "+0123456789", err: ErrInvalidPhone},
+		{name: "extension with letters", raw: "98765 43210 x1a", err: ErrInvalidPhone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PHONE_COUNTRY_CODE", tt.countryCode)
+			got, err := normalizePhone(tt.raw)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("normalizePhone(%q) error = %v, want %v", tt.raw, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizePhone(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PriceChange is one entry in an item's price history. The price applies from EffectiveFrom until
+// the next entry for the same item or variant takes over.
+type PriceChange struct {
+	ItemID            primitive.ObjectID `bson:"itemId" json:"itemId"`
+	VariantSKU        string             `bson:"variantSku,omitempty" json:"variantSku,omitempty"`
+	Price             float64            `json:"price"`
+	EffectiveFrom     time.Time          `bson:"effectiveFrom" json:"effectiveFrom"`
+	Applied           bool               `json:"applied"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type PriceChangeGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	ItemID            primitive.ObjectID `bson:"itemId" json:"itemId"`
+	VariantSKU        string             `bson:"variantSku,omitempty" json:"variantSku,omitempty"`
+	Price             float64            `json:"price"`
+	EffectiveFrom     time.Time          `bson:"effectiveFrom" json:"effectiveFrom"`
+	Applied           bool               `json:"applied"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type PriceRequest struct {
+	VariantSKU    string    `json:"variantSku"`
+	Price         float64   `json:"price"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+}
+
+var (
+	ErrItemNotFound    = errors.New("item not found")
+	ErrVariantNotFound = errors.New("variant not found")
+)
+
+// recordPrice adds a price to the history. Prices that are already in effect are marked applied;
+// future ones are picked up by applyDuePrices once their date arrives.
+func recordPrice(client *mongo.Client, key StockKey, price float64, effectiveFrom time.Time, actor string) error {
+	now := time.Now()
+	change := PriceChange{
+		ItemID:            key.ItemID,
+		VariantSKU:        key.VariantSKU,
+		Price:             roundMoney(price),
+		EffectiveFrom:     effectiveFrom,
+		Applied:           !effectiveFrom.After(now),
+		Actor:             actor,
+		CapturedTimestamp: now,
+	}
+	_, err := client.Database(Database).Collection("prices").InsertOne(context.Background(), change)
+	return err
+}
+
+// setCurrentPrice writes a price onto the item itself, which always holds the price in effect today
+func setCurrentPrice(client *mongo.Client, key StockKey, price float64) error {
+	filter := bson.M{"_id": key.ItemID}
+	update := bson.M{"$set": bson.M{"price": price}}
+	if key.VariantSKU != "" {
+		filter["variants.sku"] = key.VariantSKU
+		update = bson.M{"$set": bson.M{"variants.$.price": price}}
+	}
+	_, err := client.Database(Database).Collection("products").UpdateOne(context.Background(), filter, bumpVersion(update))
+	return err
+}
+
+// priceAt returns the price of an item or variant in effect at the given time. Items priced before
+// the history was kept fall back to the price stored on the item, or on the variant when one is
+// named; a variant the item does not have is an error rather than the item's own price.
+func priceAt(client *mongo.Client, key StockKey, at time.Time) (float64, error) {
+	filter := bson.M{"itemId": key.ItemID, "effectiveFrom": bson.M{"$lte": at}}
+	if key.VariantSKU != "" {
+		filter["variantSku"] = key.VariantSKU
+	} else {
+		filter["variantSku"] = bson.M{"$exists": false}
+	}
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "effectiveFrom", Value: -1}, {Key: "timestamp", Value: -1}})
+	var change PriceChangeGet
+	err := client.Database(Database).Collection("prices").FindOne(context.Background(), filter, findOptions).Decode(&change)
+	if err == nil {
+		return change.Price, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+
+	var item ItemGet
+	err = client.Database(Database).Collection("products").FindOne(context.Background(), bson.M{"_id": key.ItemID}).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrItemNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return storedPrice(item, key.VariantSKU)
+}
+
+// storedPrice is the price kept on the item itself, or on its variant when sku names one. A
+// variant the item does not have is ErrVariantNotFound.
+func storedPrice(item ItemGet, sku string) (float64, error) {
+	if sku == "" {
+		return item.Price, nil
+	}
+	for _, variant := range item.Variants {
+		if variant.SKU == sku {
+			return variant.Price, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s has no variant %s", ErrVariantNotFound, item.Name, sku)
+}
+
+// priceInvoiceLines snapshots each line's price: the customer's agreed price if there is one,
+// otherwise the price history as of the invoice date. Lines that are not linked to an item keep
+// the price they were given.
+func priceInvoiceLines(client *mongo.Client, custID primitive.ObjectID, lines []ItemGetInv, at time.Time) error {
+	agreed, err := customerPrices(client, custID)
+	if err != nil {
+		return err
+	}
+	for i := range lines {
+		if lines[i].ID.IsZero() {
+			continue
+		}
+		if price, ok := agreed[StockKey{ItemID: lines[i].ID, VariantSKU: lines[i].VariantSKU}]; ok {
+			lines[i].Price = price
+			continue
+		}
+		price, err := priceAt(client, StockKey{ItemID: lines[i].ID, VariantSKU: lines[i].VariantSKU}, at)
+		if err != nil {
+			return err
+		}
+		lines[i].Price = price
+	}
+	return nil
+}
+
+// applyDuePrices copies scheduled prices whose date has arrived onto their items
+func applyDuePrices(client *mongo.Client) error {
+	collection := client.Database(Database).Collection("prices")
+	filter := bson.M{"applied": false, "effectiveFrom": bson.M{"$lte": time.Now()}}
+	findOptions := options.Find().SetSort(bson.D{{Key: "effectiveFrom", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, findOptions)
+	if err != nil {
+		return err
+	}
+	var due []PriceChangeGet
+	err = cursor.All(context.Background(), &due)
+	if err != nil {
+		return err
+	}
+	for _, change := range due {
+		err = setCurrentPrice(client, StockKey{ItemID: change.ItemID, VariantSKU: change.VariantSKU}, change.Price)
+		if err != nil {
+			return err
+		}
+		_, err = collection.UpdateOne(context.Background(), bson.M{"_id": change.ID}, bson.M{"$set": bson.M{"applied": true}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedulePrice sets a new price for an item or variant, either now or from a future date
+func schedulePrice(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req PriceRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Price < 0 {
+			http.Error(w, "price must not be negative", http.StatusBadRequest)
+			return
+		}
+		// History is never rewritten, so a price can start now or later but not in the past
+		now := time.Now()
+		if req.EffectiveFrom.IsZero() {
+			req.EffectiveFrom = now
+		}
+		if req.EffectiveFrom.Before(now.Add(-time.Minute)) {
+			http.Error(w, "effectiveFrom cannot be in the past", http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{"_id": oid}
+		if req.VariantSKU != "" {
+			filter["variants.sku"] = req.VariantSKU
+		}
+		count, err := client.Database(Database).Collection("products").CountDocuments(context.Background(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count == 0 {
+			http.Error(w, "item or variant not found", http.StatusNotFound)
+			return
+		}
+
+		key := StockKey{ItemID: oid, VariantSKU: req.VariantSKU}
+		err = recordPrice(client, key, req.Price, req.EffectiveFrom, requestActor(r))
+		if err == nil && !req.EffectiveFrom.After(now) {
+			err = setCurrentPrice(client, key, roundMoney(req.Price))
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// getPriceHistory lists an item's prices, including scheduled ones, newest first
+func getPriceHistory(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{"itemId": oid}
+		if sku := r.URL.Query().Get("variantSku"); sku != "" {
+			filter["variantSku"] = sku
+		}
+		collection := client.Database(Database).Collection("prices")
+		findOptions := options.Find().SetSort(bson.D{{Key: "effectiveFrom", Value: -1}})
+		cursor, err := collection.Find(context.Background(), filter, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []PriceChangeGet
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getPriceAt returns the price of an item or variant on a given date (?at=2026-01-31 or RFC 3339),
+// defaulting to now
+func getPriceAt(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// A bare date means the price in effect at the end of that day
+		at := time.Now()
+		if value := r.URL.Query().Get("at"); value != "" {
+			at, err = parseDate(value, true)
+			if err != nil {
+				http.Error(w, "at must be a date (2006-01-02) or an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+
+		sku := r.URL.Query().Get("variantSku")
+		price, err := priceAt(client, StockKey{ItemID: oid, VariantSKU: sku}, at)
+		if errors.Is(err, ErrItemNotFound) || errors.Is(err, ErrVariantNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]interface{}{"itemId": oid, "variantSku": sku, "at": at, "price": price})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStoredPrice(t *testing.T) {
+	item := ItemGet{Name: "Pen", Price: 10, Variants: []Variant{{SKU: "PEN-BLU", Price: 12}, {SKU: "PEN-RED", Price: 11.5}}}
+	tests := []struct {
+		name    string
+		sku     string
+		want    float64
+		wantErr error
+	}{
+		{name: "item", sku: "", want: 10},
+		{name: "variant", sku: "PEN-RED", want: 11.5},
+		{name: "unknown variant", sku: "PEN-GRN", wantErr: ErrVariantNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storedPrice(item, tt.sku)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("storedPrice(%q) error = %v, want %v", tt.sku, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("storedPrice(%q) = %v, want %v", tt.sku, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ReassignRequest struct {
+	CustomerID primitive.ObjectID `json:"custId"`
+}
+
+var ErrCustomerNotFound = errors.New("customer not found")
+var ErrInvoiceNotReassignable = errors.New("invoice cannot be moved to another customer")
+
+// reassignInvoice moves an invoice to another customer. The invoice's total comes off the old
+// customer's balance and goes onto the new one's, and the invoice gets the new billing details and
+// a history entry, all in one transaction (which needs Mongo to run as a replica set).
+// Invoices with payments, credit notes or late fees are refused, since those are recorded against
+// the old customer.
+func reassignInvoice(client *mongo.Client, oid primitive.ObjectID, custID primitive.ObjectID, actor string) (InvoiceGet, error) {
+	db := client.Database(Database)
+	var invoice InvoiceGet
+	err := db.Collection("invoices").FindOne(context.Background(), bson.M{"_id": oid}).Decode(&invoice)
+	if err == mongo.ErrNoDocuments {
+		return invoice, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return invoice, err
+	}
+	var customer CustomerGet
+	err = db.Collection("customer").FindOne(context.Background(), bson.M{"_id": custID}).Decode(&customer)
+	if err == mongo.ErrNoDocuments {
+		return invoice, ErrCustomerNotFound
+	}
+	if err != nil {
+		return invoice, err
+	}
+
+	switch {
+	case invoice.CustomerID == custID:
+		return invoice, fmt.Errorf("%w: it already belongs to %s", ErrInvoiceNotReassignable, customer.Name)
+	case invoice.Status == InvoiceVoid:
+		return invoice, fmt.Errorf("%w: it is void", ErrInvoiceNotReassignable)
+	case invoice.AmountPaid > 0 || invoice.Credited > 0 || invoice.LateFees > 0:
+		return invoice, fmt.Errorf("%w: it has payments, credit notes or late fees; refund or credit them first", ErrInvoiceNotReassignable)
+	}
+
+	from := invoice.CustomerID
+	event := InvoiceEvent{Type: "reassigned", From: from.Hex(), To: custID.Hex(), Amount: invoice.Total, Actor: actor, At: time.Now()}
+	posted := invoice.Status != InvoiceDraft
+
+	session, err := client.StartSession()
+	if err != nil {
+		return invoice, err
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(context.Background(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		filter := bson.M{
+			"_id":        oid,
+			"custId":     from,
+			"amountpaid": bson.M{"$in": bson.A{0, nil}},
+			"credited":   bson.M{"$in": bson.A{0, nil}},
+			"latefees":   bson.M{"$in": bson.A{0, nil}},
+		}
+		update := bumpVersion(bson.M{"$set": bson.M{"custId": custID, "billing": billingSnapshot(customer)}, "$push": bson.M{"history": event}})
+		result, err := db.Collection("invoices").UpdateOne(sessCtx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, fmt.Errorf("%w: it changed while moving it, try again", ErrInvoiceNotReassignable)
+		}
+		if !posted {
+			return nil, nil
+		}
+		_, err = db.Collection("customer").UpdateOne(sessCtx, bson.M{"_id": from}, bson.M{"$inc": bson.M{"balance": -invoice.Total, "version": 1}})
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Collection("customer").UpdateOne(sessCtx, bson.M{"_id": custID}, bson.M{"$inc": bson.M{"balance": invoice.Total, "version": 1}})
+		return nil, err
+	})
+	if err != nil {
+		return invoice, err
+	}
+
+	invoice.CustomerID = custID
+	invoice.Billing = billingSnapshot(customer)
+	invoice.History = append(invoice.History, event)
+	invoice.Version++
+	return invoice, nil
+}
+
+// reassignInvoiceHandler moves an invoice to the customer given as custId
+func reassignInvoiceHandler(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req ReassignRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		invoice, err := reassignInvoice(client, oid, req.CustomerID, requestActor(r))
+		switch {
+		case errors.Is(err, ErrInvoiceNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrCustomerNotFound):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrInvoiceNotReassignable):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(invoice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Receipt struct {
+	Number            int64              `json:"number"`
+	ReceiptNo         string             `bson:"receiptno" json:"receiptNo"`
+	PaymentID         primitive.ObjectID `bson:"paymentId" json:"paymentId"`
+	CustomerID        string             `json:"custId"`
+	Amount            float64            `json:"amount"`
+	Mode              string             `json:"mode"`
+	StripeID          string             `json:"stripeid"`
+	Balance           float64            `json:"balance"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type ReceiptGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	Number            int64              `json:"number"`
+	ReceiptNo         string             `bson:"receiptno" json:"receiptNo"`
+	PaymentID         primitive.ObjectID `bson:"paymentId" json:"paymentId"`
+	CustomerID        string             `json:"custId"`
+	Amount            float64            `json:"amount"`
+	Mode              string             `json:"mode"`
+	StripeID          string             `json:"stripeid"`
+	Balance           float64            `json:"balance"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// issueReceipt records a receipt with the next receipt number for a captured payment.
+// balance is the customer balance remaining after the payment was applied.
+func issueReceipt(client *mongo.Client, paymentID primitive.ObjectID, payment PaymentCapture, balance float64) error {
+	seq, err := nextSequence(client, "receipt")
+	if err != nil {
+		return err
+	}
+	receipt := Receipt{
+		Number:            seq,
+		ReceiptNo:         fmt.Sprintf("RCT-%06d", seq),
+		PaymentID:         paymentID,
+		CustomerID:        payment.CustomerID,
+		Amount:            payment.Amount,
+		Mode:              payment.Mode,
+		StripeID:          payment.StripeID,
+		Balance:           balance,
+		CapturedTimestamp: payment.CapturedTimestamp,
+	}
+	collection := client.Database(Database).Collection("receipts")
+	_, err = collection.InsertOne(context.Background(), receipt)
+	return err
+}
+
+// receiptLines renders a receipt as the text lines used in the PDF version
+func receiptLines(receipt ReceiptGet) []string {
+	return []string{
+		"Receipt No: " + receipt.ReceiptNo,
+		"Date: " + receipt.CapturedTimestamp.Format("02 Jan 2006 15:04"),
+		"Customer: " + receipt.CustomerID,
+		"",
+		fmt.Sprintf("Amount received: %.2f", receipt.Amount),
+		"Payment mode: " + receipt.Mode,
+		"Reference: " + receipt.StripeID,
+		"",
+		fmt.Sprintf("Remaining balance: %.2f", receipt.Balance),
+	}
+}
+
+// getReceipt returns the receipt for a payment as JSON, or as a PDF when requested
+func getReceipt(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("receipts")
+		var receipt ReceiptGet
+		err = collection.FindOne(context.Background(), bson.M{"paymentId": oid}).Decode(&receipt)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "no receipt for payment", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if wantsPDF(r.URL.Query().Get("format"), r.Header.Get("Accept")) {
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", "inline; filename=\""+receipt.ReceiptNo+".pdf\"")
+			w.Write(renderPDF("Payment Receipt", receiptLines(receipt)))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(receipt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
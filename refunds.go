@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Refund struct {
+	Number            string              `json:"number"`
+	PaymentID         primitive.ObjectID  `bson:"paymentId" json:"paymentId"`
+	CustomerID        string              `json:"custId"`
+	Amount            float64             `json:"amount"`
+	Reason            string              `json:"reason"`
+	StripeRefundID    string              `bson:"striperefundid" json:"stripeRefundId,omitempty"`
+	Released          []PaymentAllocation `bson:"released" json:"released"`
+	Actor             string              `json:"actor"`
+	CapturedTimestamp time.Time           `bson:"timestamp" json:"timestamp"`
+}
+
+type RefundGet struct {
+	ID                primitive.ObjectID  `bson:"_id" json:"id,omitempty"`
+	Number            string              `json:"number"`
+	PaymentID         primitive.ObjectID  `bson:"paymentId" json:"paymentId"`
+	CustomerID        string              `json:"custId"`
+	Amount            float64             `json:"amount"`
+	Reason            string              `json:"reason"`
+	StripeRefundID    string              `bson:"striperefundid" json:"stripeRefundId,omitempty"`
+	Released          []PaymentAllocation `bson:"released" json:"released"`
+	Actor             string              `json:"actor"`
+	CapturedTimestamp time.Time           `bson:"timestamp" json:"timestamp"`
+}
+
+type RefundRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+var ErrPaymentNotFound = errors.New("payment not found")
+var ErrInvalidRefund = errors.New("invalid refund")
+
+// refundPayment refunds part or all of a payment while keeping the payment itself.
+// The refund comes out of the payment's unallocated credit first and is then taken back off the
+// invoices it was allocated to, newest allocation first. Credit the customer has since spent on
+// invoices is among the payment's allocations. The customer balance goes back up by
+// the refunded amount and Stripe payments are refunded through Stripe.
+func refundPayment(client *mongo.Client, paymentOid primitive.ObjectID, amount float64, reason string, actor string) (RefundGet, error) {
+	var refund RefundGet
+	collection := client.Database(Database).Collection("payments")
+	var payment PaymentCaptureGet
+	err := collection.FindOne(context.Background(), bson.M{"_id": paymentOid}).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		return refund, ErrPaymentNotFound
+	}
+	if err != nil {
+		return refund, nothingChanged(err)
+	}
+
+	if payment.Pending {
+		return refund, fmt.Errorf("%w: the payment is still being recorded", ErrInvalidRefund)
+	}
+	refundable := roundMoney(payment.Amount - payment.Refunded)
+	if amount == 0 {
+		amount = refundable
+	}
+	amount = roundMoney(amount)
+	if amount <= 0 || amount > refundable {
+		return refund, fmt.Errorf("%w: %.2f of this payment can be refunded", ErrInvalidRefund, refundable)
+	}
+	custOid, err := primitive.ObjectIDFromHex(payment.CustomerID)
+	if err != nil {
+		return refund, nothingChanged(err)
+	}
+	var customer CustomerGet
+	err = client.Database(Database).Collection("customer").FindOne(context.Background(), bson.M{"_id": custOid}).Decode(&customer)
+	if err != nil {
+		return refund, nothingChanged(err)
+	}
+
+	// Credit spent before it was tracked per payment can leave a payment holding more credit than
+	// its customer has left, so never take more than that
+	credit := math.Min(payment.Credit, math.Max(customer.Credit, 0))
+	fromCredit := math.Min(amount, credit)
+	remaining := roundMoney(amount - fromCredit)
+	allocations := append([]PaymentAllocation{}, payment.Allocations...)
+	var released []PaymentAllocation
+	for i := len(allocations) - 1; i >= 0 && remaining > 0; i-- {
+		take := math.Min(allocations[i].Amount, remaining)
+		released = append(released, PaymentAllocation{InvoiceID: allocations[i].InvoiceID, Amount: take})
+		allocations[i].Amount = roundMoney(allocations[i].Amount - take)
+		remaining = roundMoney(remaining - take)
+	}
+	var kept []PaymentAllocation
+	for _, allocation := range allocations {
+		if allocation.Amount > 0 {
+			kept = append(kept, allocation)
+		}
+	}
+
+	// Conditional on the refunded amount we read, so concurrent refunds cannot overdraw the payment.
+	// Payments recorded before refunds existed have no refunded field at all.
+	filter := bson.M{"_id": paymentOid, "refunded": payment.Refunded}
+	if payment.Refunded == 0 {
+		filter["refunded"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	update := bumpVersion(bson.M{"$set": bson.M{"allocations": kept, "credit": roundMoney(credit - fromCredit), "refunded": roundMoney(payment.Refunded + amount)}})
+	seq, err := nextSequence(client, "refund")
+	if err != nil {
+		return refund, nothingChanged(err)
+	}
+	number := fmt.Sprintf("RF-%06d", seq)
+	result, err := collection.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return refund, nothingChanged(err)
+	}
+	if result.MatchedCount == 0 {
+		return refund, fmt.Errorf("%w: payment changed while refunding, try again", ErrInvalidRefund)
+	}
+
+	var stripeRefundID string
+	if payment.Mode == "stripe" && payment.StripeID != "" {
+		form := url.Values{}
+		form.Set("payment_intent", payment.StripeID)
+		form.Set("amount", strconv.FormatInt(stripeMinorUnits(amount), 10))
+		form.Set("metadata[refund]", number)
+		var stripeRefund struct {
+			ID string `json:"id"`
+		}
+		err = stripePost("/v1/refunds", form, &stripeRefund)
+		if err != nil {
+			// Put the payment back as it was so the refund can be retried
+			collection.UpdateOne(context.Background(), bson.M{"_id": paymentOid}, bumpVersion(bson.M{"$set": bson.M{"allocations": payment.Allocations, "credit": payment.Credit, "refunded": payment.Refunded}}))
+			return refund, nothingChanged(err)
+		}
+		stripeRefundID = stripeRefund.ID
+	}
+
+	err = adjustCredit(client, custOid, -fromCredit)
+	if err != nil {
+		return refund, err
+	}
+	err = releaseAllocations(client, released, number, actor)
+	if err != nil {
+		return refund, err
+	}
+	_, err = adjustBalance(client, custOid, amount)
+	if err != nil {
+		return refund, err
+	}
+
+	item := Refund{
+		Number:            number,
+		PaymentID:         paymentOid,
+		CustomerID:        payment.CustomerID,
+		Amount:            amount,
+		Reason:            reason,
+		StripeRefundID:    stripeRefundID,
+		Released:          released,
+		Actor:             actor,
+		CapturedTimestamp: time.Now(),
+	}
+	inserted, err := client.Database(Database).Collection("refunds").InsertOne(context.Background(), item)
+	if err != nil {
+		return refund, err
+	}
+	refund = RefundGet{
+		ID:                inserted.InsertedID.(primitive.ObjectID),
+		Number:            item.Number,
+		PaymentID:         item.PaymentID,
+		CustomerID:        item.CustomerID,
+		Amount:            item.Amount,
+		Reason:            item.Reason,
+		StripeRefundID:    item.StripeRefundID,
+		Released:          item.Released,
+		Actor:             item.Actor,
+		CapturedTimestamp: item.CapturedTimestamp,
+	}
+	return refund, nil
+}
+
+// refundErrorStatus maps refund errors to HTTP statuses
+func refundErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPaymentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidRefund):
+		return http.StatusConflict
+	case errors.Is(err, ErrStripeNotConfigured):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// addRefund refunds a payment in full or in part; an amount of 0 refunds what is left
+func addRefund(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req RefundRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		refund, err := refundPayment(client, oid, req.Amount, req.Reason, requestActor(r))
+		if err != nil {
+			log.Println(err.Error())
+			releaseIfUnchanged(w, err)
+			http.Error(w, err.Error(), refundErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(refund)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getRefunds lists refunds, optionally for one payment, as JSON or CSV (?format=csv)
+func getRefunds(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := bson.M{}
+		if paymentID := r.URL.Query().Get("paymentId"); paymentID != "" {
+			oid, err := primitive.ObjectIDFromHex(paymentID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter["paymentId"] = oid
+		}
+
+		collection := client.Database(Database).Collection("refunds")
+		findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+		cursor, err := collection.Find(context.Background(), filter, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []RefundGet
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "csv" {
+			var rows [][]string
+			for _, item := range items {
+				rows = append(rows, []string{item.Number, item.CapturedTimestamp.Format(time.RFC3339), item.PaymentID.Hex(), item.CustomerID, formatMoney(item.Amount), item.Reason, item.StripeRefundID, item.Actor})
+			}
+			writeCSV(w, "refunds.csv", []string{"number", "date", "paymentId", "custId", "amount", "reason", "stripeRefundId", "actor"}, rows)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRefundErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "payment not found", err: ErrPaymentNotFound, want: http.StatusNotFound},
+		{name: "wrapped invalid refund", err: fmt.Errorf("%w: only 5.00 is left to refund", ErrInvalidRefund), want: http.StatusConflict},
+		{name: "stripe not configured", err: ErrStripeNotConfigured, want: http.StatusServiceUnavailable},
+		{name: "anything else", err: errors.New("connection reset"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refundErrorStatus(tt.err); got != tt.want {
+				t.Errorf("refundErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchResults = 20
+	maxSearchResults     = 100
+
+	// searchRebuildInterval is how often the search index is reloaded in full, to pick up records
+	// changed by other instances or by writes that do not update it
+	searchRebuildInterval = 10 * time.Minute
+)
+
+// SearchResult is one customer or item matching a search, best matches first
+type SearchResult struct {
+	Kind     string             `json:"kind"`
+	ID       primitive.ObjectID `json:"id"`
+	Title    string             `json:"title"`
+	Subtitle string             `json:"subtitle"`
+	Score    float64            `json:"score"`
+}
+
+// searchField is a piece of text to search with how much a match in it counts. Words are split
+// out when the record is indexed so searches do not have to.
+type searchField struct {
+	text   string
+	words  []string
+	weight float64
+	phone  bool
+}
+
+// searchKey identifies a record in the search index
+type searchKey struct {
+	kind string
+	id   primitive.ObjectID
+}
+
+// searchEntry is an indexed customer or item
+type searchEntry struct {
+	title    string
+	subtitle string
+	fields   []searchField
+}
+
+// searchIndex holds the searchable text of every customer and item that is not deleted. It is
+// loaded on the first search, kept up to date by the routes that write those fields and rebuilt
+// periodically by the search-index job.
+type searchIndex struct {
+	mu      sync.RWMutex
+	loaded  bool
+	entries map[searchKey]searchEntry
+}
+
+var searchIdx = &searchIndex{}
+
+// searchCollections maps the collections that are searched to the kind of result they give
+var searchCollections = map[string]string{
+	"customer": "customer",
+	"products": "item",
+}
+
+// searchCustomer is the part of a customer document that is searched
+type searchCustomer struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Name        string             `bson:"name"`
+	Careof      string             `bson:"careof"`
+	Address     string             `bson:"address"`
+	Description string             `bson:"description"`
+	Numbers     []PhoneNumber      `bson:"numbers"`
+}
+
+// searchItem is the part of an item document that is searched
+type searchItem struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Name        string             `bson:"name"`
+	Description string             `bson:"description"`
+	SKU         string             `bson:"sku"`
+}
+
+var (
+	searchCustomerProjection = bson.M{"name": 1, "careof": 1, "address": 1, "description": 1, "numbers": 1}
+	searchItemProjection     = bson.M{"name": 1, "description": 1, "sku": 1}
+)
+
+// searchWords splits text into lower case words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchTerms splits a query into terms. Runs of digit-only words are joined into one so a phone
+// number typed with spaces, like +91 98765 43210, is matched as a whole.
+func searchTerms(query string) []string {
+	var terms []string
+	digitRun := false
+	for _, word := range searchWords(query) {
+		digits := strings.IndexFunc(word, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+		if digits && digitRun {
+			terms[len(terms)-1] += word
+			continue
+		}
+		terms = append(terms, word)
+		digitRun = digits
+	}
+	return terms
+}
+
+// indexedFields splits the words out of a record's fields
+func indexedFields(fields []searchField) []searchField {
+	for i := range fields {
+		if !fields[i].phone {
+			fields[i].words = searchWords(fields[i].text)
+		}
+	}
+	return fields
+}
+
+func customerSearchEntry(customer searchCustomer) searchEntry {
+	fields := []searchField{
+		{text: customer.Name, weight: 3},
+		{text: customer.Careof, weight: 2},
+		{text: customer.Address, weight: 1},
+		{text: customer.Description, weight: 1},
+	}
+	for _, number := range customer.Numbers {
+		fields = append(fields, searchField{text: string(number), weight: 3, phone: true})
+	}
+	return searchEntry{title: customer.Name, subtitle: customer.Address, fields: indexedFields(fields)}
+}
+
+func itemSearchEntry(item searchItem) searchEntry {
+	fields := []searchField{
+		{text: item.Name, weight: 3},
+		{text: item.SKU, weight: 3},
+		{text: item.Description, weight: 1},
+	}
+	return searchEntry{title: item.Name, subtitle: item.Description, fields: indexedFields(fields)}
+}
+
+// rebuild reloads the whole index from the customer and products collections
+func (idx *searchIndex) rebuild(client *mongo.Client) error {
+	db := client.Database(Database)
+	entries := map[searchKey]searchEntry{}
+
+	cursor, err := db.Collection("customer").Find(context.Background(), notDeleted(nil, bson.M{}), options.Find().SetProjection(searchCustomerProjection))
+	if err != nil {
+		return err
+	}
+	var customers []searchCustomer
+	err = cursor.All(context.Background(), &customers)
+	if err != nil {
+		return err
+	}
+	for _, customer := range customers {
+		entries[searchKey{"customer", customer.ID}] = customerSearchEntry(customer)
+	}
+
+	cursor, err = db.Collection("products").Find(context.Background(), notDeleted(nil, bson.M{}), options.Find().SetProjection(searchItemProjection))
+	if err != nil {
+		return err
+	}
+	var items []searchItem
+	err = cursor.All(context.Background(), &items)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		entries[searchKey{"item", item.ID}] = itemSearchEntry(item)
+	}
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.loaded = true
+	idx.mu.Unlock()
+	return nil
+}
+
+// rebuildSearchIndex is the search-index job
+func rebuildSearchIndex(client *mongo.Client) error {
+	return searchIdx.rebuild(client)
+}
+
+// updateSearchIndex re-reads one record after it was written, dropping it from the index when it
+// is gone or deleted. Writes to collections that are not searched are ignored, and so is
+// everything until the index has first been loaded. A failure is only logged; the next rebuild
+// catches up.
+func updateSearchIndex(client *mongo.Client, collection string, oid primitive.ObjectID) {
+	kind, ok := searchCollections[collection]
+	if !ok {
+		return
+	}
+	searchIdx.mu.RLock()
+	loaded := searchIdx.loaded
+	searchIdx.mu.RUnlock()
+	if !loaded {
+		return
+	}
+
+	var entry searchEntry
+	var err error
+	filter := notDeleted(nil, bson.M{"_id": oid})
+	if kind == "customer" {
+		var customer searchCustomer
+		err = client.Database(Database).Collection(collection).FindOne(context.Background(), filter, options.FindOne().SetProjection(searchCustomerProjection)).Decode(&customer)
+		entry = customerSearchEntry(customer)
+	} else {
+		var item searchItem
+		err = client.Database(Database).Collection(collection).FindOne(context.Background(), filter, options.FindOne().SetProjection(searchItemProjection)).Decode(&item)
+		entry = itemSearchEntry(item)
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("search index:", err.Error())
+		return
+	}
+
+	searchIdx.mu.Lock()
+	defer searchIdx.mu.Unlock()
+	if err == mongo.ErrNoDocuments {
+		delete(searchIdx.entries, searchKey{kind, oid})
+	} else {
+		searchIdx.entries[searchKey{kind, oid}] = entry
+	}
+}
+
+// editDistance is the Levenshtein distance between two words
+func editDistance(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// wordMatch scores how well a query term matches a word: 1 for the whole word, 0.8 for the start of
+// it while typing, and 0.5 when the start of it is a typo or two away from the term
+func wordMatch(term, word string) float64 {
+	switch {
+	case term == word:
+		return 1
+	case strings.HasPrefix(word, term):
+		return 0.8
+	}
+	t, w := []rune(term), []rune(word)
+	allowed := 0
+	switch {
+	case len(t) >= 8:
+		allowed = 2
+	case len(t) >= 4:
+		allowed = 1
+	}
+	if allowed == 0 {
+		return 0
+	}
+	// Compare against the start of the word a little either side of the term's length
+	for n := len(t) - allowed; n <= len(t)+allowed; n++ {
+		if n > 0 && n <= len(w) && editDistance(t, w[:n]) <= allowed {
+			return 0.5
+		}
+	}
+	return 0
+}
+
+// searchScore scores a record's fields against the query terms. Every term has to match somewhere;
+// each counts its best match weighted by the field it was found in.
+func searchScore(terms []string, fields []searchField) float64 {
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for _, field := range fields {
+			if field.phone {
+				digits := strings.Map(func(r rune) rune {
+					if unicode.IsDigit(r) {
+						return r
+					}
+					return -1
+				}, term)
+				if len(digits) >= 3 && strings.Contains(field.text, digits) {
+					best = max(best, field.weight)
+				}
+				continue
+			}
+			for _, word := range field.words {
+				best = max(best, field.weight*wordMatch(term, word))
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+// search ranks customers and items against the query. Records are scored against the in-memory
+// index, which gives typo-tolerant prefix matching that Mongo text indexes do not, without reading
+// the collections on every search.
+func search(client *mongo.Client, query string) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	results := []SearchResult{}
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	searchIdx.mu.RLock()
+	loaded := searchIdx.loaded
+	searchIdx.mu.RUnlock()
+	if !loaded {
+		err := searchIdx.rebuild(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	searchIdx.mu.RLock()
+	for key, entry := range searchIdx.entries {
+		if score := searchScore(terms, entry.fields); score > 0 {
+			results = append(results, SearchResult{Kind: key.kind, ID: key.id, Title: entry.title, Subtitle: entry.subtitle, Score: score})
+		}
+	}
+	searchIdx.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Title != results[j].Title {
+			return results[i].Title < results[j].Title
+		}
+		return results[i].ID.Hex() < results[j].ID.Hex()
+	})
+	return results, nil
+}
+
+// searchHandler searches customers and items for ?q=, returning up to ?limit= results best first
+func searchHandler(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultSearchResults
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		if limit > maxSearchResults {
+			limit = maxSearchResults
+		}
+
+		results, err := search(client, r.URL.Query().Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(results) > limit {
+			results = results[:limit]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(results)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
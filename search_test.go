@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSearchWords(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "Asha-Traders, Pune 411001", want: []string{"asha", "traders", "pune", "411001"}},
+		{text: "Café Noir", want: []string{"café", "noir"}},
+		{text: "  ", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got := searchWords(tt.text)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("searchWords(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "Asha traders", want: []string{"asha", "traders"}},
+		{query: "+91 98765 43210", want: []string{"919876543210"}},
+		{query: "asha 98765 43210 pune", want: []string{"asha", "9876543210", "pune"}},
+		{query: "route 66 2024", want: []string{"route", "662024"}},
+		{query: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := searchTerms(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("searchTerms(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "kitten", b: "sitting", want: 3},
+		{a: "flaw", b: "lawn", want: 2},
+		{a: "pen", b: "pen", want: 0},
+		{a: "", b: "abc", want: 3},
+		{a: "asha", b: "ahsa", want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if got := editDistance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+				t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWordMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		term, word string
+		want       float64
+	}{
+		{name: "whole word", term: "pen", word: "pen", want: 1},
+		{name: "prefix while typing", term: "pe", word: "pencil", want: 0.8},
+		{name: "one typo", term: "pencl", word: "pencil", want: 0.5},
+		{name: "typo in the start of a longer word", term: "stapel", word: "stapler", want: 0.5},
+		{name: "two typos in a long word", term: "stasionary", word: "stationery", want: 0.5},
+		{name: "short terms must be exact", term: "pan", word: "pen", want: 0},
+		{name: "too many typos", term: "pncl", word: "pencil", want: 0},
+		{name: "no match", term: "xyz", word: "pencil", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wordMatch(tt.term, tt.word); got != tt.want {
+				t.Errorf("wordMatch(%q, %q) = %v, want %v", tt.term, tt.word, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchScore(t *testing.T) {
+	fields := indexedFields([]searchField{
+		{text: "Asha Traders", weight: 3},
+		{text: "Market Road", weight: 1},
+		{text: "+919876543210", weight: 3, phone: true},
+	})
+	tests := []struct {
+		name  string
+		terms []string
+		want  float64
+	}{
+		{name: "name", terms: []string{"asha"}, want: 3},
+		{name: "name prefix", terms: []string{"trad"}, want: 2.4},
+		{name: "name typo", terms: []string{"traderz"}, want: 1.5},
+		{name: "terms in different fields", terms: []string{"asha", "road"}, want: 4},
+		{name: "every term must match", terms: []string{"asha", "delhi"}, want: 0},
+		{name: "part of a phone number", terms: []string{"98765"}, want: 3},
+		{name: "too few digits for a phone number", terms: []string{"98"}, want: 0},
+		{name: "phone number typed with spaces", terms: searchTerms("98765 43210"), want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := searchScore(tt.terms, fields); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("searchScore(%q) = %v, want %v", tt.terms, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// trashKinds maps the kinds of record that can be deleted to their collections
+var trashKinds = map[string]string{
+	"items":     "products",
+	"customers": "customer",
+	"invoices":  "invoices",
+	"payments":  "payments",
+}
+
+// TrashEntry is a deleted record waiting to be restored or purged
+type TrashEntry struct {
+	Kind      string             `json:"kind"`
+	ID        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	DeletedAt time.Time          `json:"deletedAt"`
+	DeletedBy string             `json:"deletedBy"`
+	PurgeAt   time.Time          `json:"purgeAt"`
+}
+
+// trashRetention is how long deleted records are kept before they are purged, TRASH_RETENTION_DAYS
+// (default 30)
+func trashRetention() time.Duration {
+	return time.Duration(envFloat("TRASH_RETENTION_DAYS", 30) * float64(24*time.Hour))
+}
+
+// notDeleted adds the condition that leaves deleted records out, unless the request asks for them
+// with ?includeDeleted=true. Pass a nil request for lookups that should never see them.
+func notDeleted(r *http.Request, filter bson.M) bson.M {
+	if r != nil && r.URL.Query().Get("includeDeleted") == "true" {
+		return filter
+	}
+	filter["deletedAt"] = bson.M{"$exists": false}
+	return filter
+}
+
+// softDelete marks the record matching filter as deleted by actor. It reports false when nothing
+// matched, including when the record is already deleted.
+func softDelete(client *mongo.Client, collection string, filter bson.M, actor string) (bool, error) {
+	update := bson.M{"$set": bson.M{"deletedAt": time.Now(), "deletedBy": actor}}
+	result, err := client.Database(Database).Collection(collection).UpdateOne(context.Background(), notDeleted(nil, filter), update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// deletePayment deletes a payment that has been fully refunded or reverted, so no longer counts
+// towards any balance
+func deletePayment(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		count, err := client.Database(Database).Collection("payments").CountDocuments(context.Background(), notDeleted(nil, bson.M{"_id": oid}))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count == 0 {
+			http.Error(w, "payment not found", http.StatusNotFound)
+			return
+		}
+
+		filter := bson.M{"_id": oid, "$expr": bson.M{"$gte": bson.A{"$refunded", "$amount"}}}
+		deleted, err := softDelete(client, "payments", filter, requestActor(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "only fully refunded or reverted payments can be deleted", http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// getTrash lists deleted records, most recently deleted first, optionally of one ?kind=
+func getTrash(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kinds := trashKinds
+		if kind := r.URL.Query().Get("kind"); kind != "" {
+			collection, ok := trashKinds[kind]
+			if !ok {
+				http.Error(w, "kind must be items, customers, invoices or payments", http.StatusBadRequest)
+				return
+			}
+			kinds = map[string]string{kind: collection}
+		}
+
+		entries := []TrashEntry{}
+		for kind, collection := range kinds {
+			cursor, err := client.Database(Database).Collection(collection).Find(context.Background(), bson.M{"deletedAt": bson.M{"$exists": true}})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var docs []bson.M
+			err = cursor.All(context.Background(), &docs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, doc := range docs {
+				entries = append(entries, trashEntry(kind, doc))
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].DeletedAt.After(entries[j].DeletedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// trashEntry describes a deleted document: items and customers by name, invoices by number and
+// payments by amount
+func trashEntry(kind string, doc bson.M) TrashEntry {
+	entry := TrashEntry{Kind: kind}
+	entry.ID, _ = doc["_id"].(primitive.ObjectID)
+	if deletedAt, ok := doc["deletedAt"].(primitive.DateTime); ok {
+		entry.DeletedAt = deletedAt.Time()
+	}
+	entry.DeletedBy, _ = doc["deletedBy"].(string)
+	entry.PurgeAt = entry.DeletedAt.Add(trashRetention())
+	switch kind {
+	case "invoices":
+		entry.Name, _ = doc["number"].(string)
+	case "payments":
+		amount, _ := doc["amount"].(float64)
+		mode, _ := doc["mode"].(string)
+		entry.Name = formatMoney(amount) + " " + mode
+	default:
+		entry.Name, _ = doc["name"].(string)
+	}
+	return entry
+}
+
+// restoreDeleted brings a deleted record back
+func restoreDeleted(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection, ok := trashKinds[vars["kind"]]
+		if !ok {
+			http.Error(w, "kind must be items, customers, invoices or payments", http.StatusBadRequest)
+			return
+		}
+		oid, err := primitive.ObjectIDFromHex(vars["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{"_id": oid, "deletedAt": bson.M{"$exists": true}}
+		update := bson.M{"$unset": bson.M{"deletedAt": "", "deletedBy": ""}}
+		result, err := client.Database(Database).Collection(collection).UpdateOne(context.Background(), filter, update)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result.MatchedCount == 0 {
+			http.Error(w, "not found in trash", http.StatusNotFound)
+			return
+		}
+		updateSearchIndex(client, collection, oid)
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// purgeTrash permanently deletes records that have been in the trash longer than the retention
+// period. Items and customers take their own price records with them, and payments their refunds
+// and receipts so statements are not left with a refund for a payment that is gone. One that
+// something has come to depend on since it was deleted is left in the trash.
+func purgeTrash(client *mongo.Client) error {
+	cutoff := time.Now().Add(-trashRetention())
+	for kind, collection := range trashKinds {
+		cursor, err := client.Database(Database).Collection(collection).Find(context.Background(), bson.M{"deletedAt": bson.M{"$lt": cutoff}})
+		if err != nil {
+			return err
+		}
+		var docs []bson.M
+		err = cursor.All(context.Background(), &docs)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			oid, _ := doc["_id"].(primitive.ObjectID)
+			blockers, cascade := map[string]bson.M{}, map[string]bson.M{}
+			switch kind {
+			case "items":
+				blockers, cascade = itemDependents(oid)
+			case "customers":
+				blockers, _ = customerDependents(oid)
+				cascade = map[string]bson.M{"customerprices": {"custId": oid}}
+			case "payments":
+				cascade = map[string]bson.M{"refunds": {"paymentId": oid}, "receipts": {"paymentId": oid}}
+			}
+			dependents, err := countDependents(client, blockers)
+			if err != nil {
+				return err
+			}
+			if len(dependents) > 0 {
+				log.Printf("purge-trash: keeping %s %s, still referenced by %v", kind, oid.Hex(), dependents)
+				continue
+			}
+			err = deleteMany(client, cascade, collection, oid, nil)
+			if err != nil {
+				return err
+			}
+			// A deleted draft held on to its coupon use in case it was restored
+			if coupon, _ := doc["coupon"].(string); kind == "invoices" && coupon != "" {
+				releaseCoupon(client, coupon)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNotDeleted(t *testing.T) {
+	hidden := bson.M{"$exists": false}
+	tests := []struct {
+		name  string
+		query string
+		nilR  bool
+		want  bson.M
+	}{
+		{name: "plain request", query: "", want: bson.M{"status": "issued", "deletedAt": hidden}},
+		{name: "includeDeleted", query: "?includeDeleted=true", want: bson.M{"status": "issued"}},
+		{name: "includeDeleted other value", query: "?includeDeleted=1", want: bson.M{"status": "issued", "deletedAt": hidden}},
+		{name: "no request", nilR: true, want: bson.M{"status": "issued", "deletedAt": hidden}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r *http.Request
+			if !tt.nilR {
+				r = httptest.NewRequest(http.MethodGet, "/invoices"+tt.query, nil)
+			}
+			if got := notDeleted(r, bson.M{"status": "issued"}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("notDeleted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrashRetention(t *testing.T) {
+	t.Setenv("TRASH_RETENTION_DAYS", "")
+	if got := trashRetention(); got != 30*24*time.Hour {
+		t.Errorf("default trashRetention() = %v, want 30 days", got)
+	}
+	t.Setenv("TRASH_RETENTION_DAYS", "7")
+	if got := trashRetention(); got != 7*24*time.Hour {
+		t.Errorf("trashRetention() = %v, want 7 days", got)
+	}
+}
+
+func TestTrashEntry(t *testing.T) {
+	t.Setenv("TRASH_RETENTION_DAYS", "10")
+	oid := primitive.NewObjectID()
+	deletedAt := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+	purgeAt := deletedAt.Add(10 * 24 * time.Hour)
+	tests := []struct {
+		kind string
+		doc  bson.M
+		name string
+	}{
+		{kind: "customers", doc: bson.M{"name": "Asha Traders"}, name: "Asha Traders"},
+		{kind: "items", doc: bson.M{"name": "Blue pen"}, name: "Blue pen"},
+		{kind: "invoices", doc: bson.M{"number": "INV-2024-000012", "name": "ignored"}, name: "INV-2024-000012"},
+		{kind: "payments", doc: bson.M{"amount": 150.5, "mode": "cash"}, name: "150.50 cash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			tt.doc["_id"] = oid
+			tt.doc["deletedAt"] = primitive.NewDateTimeFromTime(deletedAt)
+			tt.doc["deletedBy"] = "priya"
+			want := TrashEntry{Kind: tt.kind, ID: oid, Name: tt.name, DeletedAt: deletedAt, DeletedBy: "priya", PurgeAt: purgeAt}
+			got := trashEntry(tt.kind, tt.doc)
+			if got.Kind != want.Kind || got.ID != want.ID || got.Name != want.Name || got.DeletedBy != want.DeletedBy ||
+				!got.DeletedAt.Equal(want.DeletedAt) || !got.PurgeAt.Equal(want.PurgeAt) {
+				t.Errorf("trashEntry() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StatementEntry is one line of a customer statement. Debits raise what the customer owes and
+// credits lower it.
+type StatementEntry struct {
+	Date        time.Time `json:"date"`
+	Type        string    `json:"type"`
+	Ref         string    `json:"ref"`
+	Description string    `json:"description"`
+	Debit       float64   `json:"debit"`
+	Credit      float64   `json:"credit"`
+	Balance     float64   `json:"balance"`
+}
+
+type Statement struct {
+	Customer       CustomerGet      `json:"customer"`
+	From           time.Time        `json:"from"`
+	To             time.Time        `json:"to"`
+	OpeningBalance float64          `json:"openingBalance"`
+	Entries        []StatementEntry `json:"entries"`
+	ClosingBalance float64          `json:"closingBalance"`
+}
+
+// customerLedger collects every invoice, payment, refund, credit note and adjustment that has
+// changed a customer's balance, oldest first
+func customerLedger(client *mongo.Client, customer CustomerGet) ([]StatementEntry, error) {
+	var entries []StatementEntry
+	db := client.Database(Database)
+
+	var invoices []InvoiceGet
+	cursor, err := db.Collection("invoices").Find(context.Background(), bson.M{"custId": customer.ID, "status": bson.M{"$ne": InvoiceDraft}})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.Background(), &invoices)
+	if err != nil {
+		return nil, err
+	}
+	for _, invoice := range invoices {
+		var voided *InvoiceEvent
+		for i, event := range invoice.History {
+			if event.Type == "status" && event.To == InvoiceVoid {
+				voided = &invoice.History[i]
+			}
+		}
+		// Drafts that were voided never reached the balance
+		if voided != nil && voided.From == InvoiceDraft {
+			continue
+		}
+		entries = append(entries, StatementEntry{Date: invoice.Date, Type: "invoice", Ref: invoice.Number, Description: "Invoice " + invoice.Number, Debit: invoice.Total})
+		// Voiding takes what was left of the invoice back off the balance at the time it was voided.
+		// Invoices voided before the amount was recorded had their whole total reversed.
+		if voided != nil {
+			amount := voided.Amount
+			if amount == 0 {
+				amount = invoice.Total
+			}
+			entries = append(entries, StatementEntry{Date: voided.At, Type: "void", Ref: invoice.Number, Description: "Invoice " + invoice.Number + " voided", Credit: amount})
+		}
+	}
+
+	var payments []PaymentCaptureGet
+	cursor, err = db.Collection("payments").Find(context.Background(), bson.M{"customerid": customer.ID.Hex()})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.Background(), &payments)
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		entries = append(entries, StatementEntry{Date: payment.CapturedTimestamp, Type: "payment", Ref: payment.ID.Hex(), Description: "Payment (" + payment.Mode + ")", Credit: payment.Amount})
+	}
+
+	var refunds []RefundGet
+	cursor, err = db.Collection("refunds").Find(context.Background(), bson.M{"customerid": customer.ID.Hex()})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.Background(), &refunds)
+	if err != nil {
+		return nil, err
+	}
+	for _, refund := range refunds {
+		entries = append(entries, StatementEntry{Date: refund.CapturedTimestamp, Type: "refund", Ref: refund.Number, Description: "Refund " + refund.Number + " " + refund.Reason, Debit: refund.Amount})
+	}
+
+	var creditNotes []CreditNoteGet
+	cursor, err = db.Collection("creditnotes").Find(context.Background(), bson.M{"custId": customer.ID})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.Background(), &creditNotes)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range creditNotes {
+		entries = append(entries, StatementEntry{Date: note.CapturedTimestamp, Type: "credit_note", Ref: note.Number, Description: "Credit note " + note.Number + " on " + note.InvoiceNumber, Credit: note.Amount})
+	}
+
+	var adjustments []AdjustmentGet
+	cursor, err = db.Collection("adjustments").Find(context.Background(), bson.M{"custId": customer.ID})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.Background(), &adjustments)
+	if err != nil {
+		return nil, err
+	}
+	for _, adjustment := range adjustments {
+		entry := StatementEntry{Date: adjustment.CapturedTimestamp, Type: adjustment.Type, Ref: adjustment.Number, Description: adjustment.Reason}
+		if adjustment.Amount >= 0 {
+			entry.Debit = adjustment.Amount
+		} else {
+			entry.Credit = -adjustment.Amount
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+	return entries, nil
+}
+
+// recordBalanceAdjustment records a change to a customer's balance that no invoice, payment, refund
+// or credit note accounts for, so their statement still adds up to the balance. Changing the
+// balance itself is up to the caller.
+func recordBalanceAdjustment(client *mongo.Client, custID primitive.ObjectID, kind string, amount float64, reason string, actor string, at time.Time) (Adjustment, error) {
+	seq, err := nextSequence(client, "adjustment")
+	if err != nil {
+		return Adjustment{}, err
+	}
+	adjustment := Adjustment{
+		Number:            fmt.Sprintf("ADJ-%06d", seq),
+		Type:              kind,
+		CustomerID:        custID,
+		Amount:            amount,
+		Reason:            reason,
+		Actor:             actor,
+		CapturedTimestamp: at,
+	}
+	_, err = client.Database(Database).Collection("adjustments").InsertOne(context.Background(), adjustment)
+	return adjustment, err
+}
+
+// BalanceAdjustmentRequest sets a customer's balance by hand. Amount is added to the balance.
+type BalanceAdjustmentRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// addBalanceAdjustment changes a customer's balance by hand, such as to correct a mistake no
+// invoice, payment or credit note covers, and records it as an adjustment on their statement
+func addBalanceAdjustment(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req BalanceAdjustmentRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Amount = roundMoney(req.Amount)
+		if req.Amount == 0 {
+			http.Error(w, "amount must not be zero", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			http.Error(w, "reason is required", http.StatusBadRequest)
+			return
+		}
+
+		var customer CustomerGet
+		err = client.Database(Database).Collection("customer").FindOne(context.Background(), notDeleted(nil, bson.M{"_id": oid})).Decode(&customer)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "customer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		adjustment, err := recordBalanceAdjustment(client, oid, "balance_adjustment", req.Amount, req.Reason, requestActor(r), time.Now())
+		if err != nil {
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = adjustBalance(client, oid, req.Amount)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updateSearchIndex(client, "customer", oid)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(adjustment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// recordOpeningBalances gives every customer whose balance differs from what their ledger adds up to,
+// such as balances carried over from before invoices and payments were recorded, an opening
+// balance adjustment for the difference dated before their first entry
+func recordOpeningBalances(client *mongo.Client) (int, error) {
+	cursor, err := client.Database(Database).Collection("customer").Find(context.Background(), bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	var customers []CustomerGet
+	err = cursor.All(context.Background(), &customers)
+	if err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	for _, customer := range customers {
+		ledger, err := customerLedger(client, customer)
+		if err != nil {
+			return recorded, err
+		}
+		total := 0.0
+		for _, entry := range ledger {
+			total += entry.Debit - entry.Credit
+		}
+		difference := roundMoney(customer.Balance - total)
+		if difference == 0 {
+			continue
+		}
+		at := customer.CapturedTimestamp
+		if len(ledger) > 0 && !at.Before(ledger[0].Date) {
+			at = ledger[0].Date.Add(-time.Second)
+		}
+		_, err = recordBalanceAdjustment(client, customer.ID, "opening_balance", difference, "Opening balance", systemActor, at)
+		if err != nil {
+			return recorded, err
+		}
+		recorded++
+	}
+	return recorded, nil
+}
+
+// buildStatement works out the opening balance at from, the entries up to to with a running
+// balance, and the closing balance
+func buildStatement(customer CustomerGet, ledger []StatementEntry, from, to time.Time) Statement {
+	statement := Statement{Customer: customer, From: from, To: to, Entries: []StatementEntry{}}
+	balance := 0.0
+	for _, entry := range ledger {
+		if entry.Date.After(to) {
+			break
+		}
+		balance = roundMoney(balance + entry.Debit - entry.Credit)
+		if entry.Date.Before(from) {
+			statement.OpeningBalance = balance
+			continue
+		}
+		entry.Balance = balance
+		statement.Entries = append(statement.Entries, entry)
+	}
+	statement.ClosingBalance = balance
+	return statement
+}
+
+func statementLines(statement Statement) []string {
+	lines := []string{
+		"Customer: " + statement.Customer.Name,
+		"Address: " + statement.Customer.Address,
+		"Period: " + statement.From.Format("02 Jan 2006") + " to " + statement.To.Format("02 Jan 2006"),
+		"",
+		fmt.Sprintf("Opening balance: %.2f", statement.OpeningBalance),
+		"",
+	}
+	for _, entry := range statement.Entries {
+		amount := fmt.Sprintf("%.2f", entry.Debit)
+		if entry.Credit > 0 {
+			amount = fmt.Sprintf("-%.2f", entry.Credit)
+		}
+		lines = append(lines, fmt.Sprintf("%s  %-40s %12s %12.2f", entry.Date.Format("02 Jan 2006"), entry.Description, amount, entry.Balance))
+	}
+	lines = append(lines, "", fmt.Sprintf("Closing balance: %.2f", statement.ClosingBalance))
+	return lines
+}
+
+// getCustomerStatement returns a customer's account statement for a period (?from=&to=, default
+// this month) as JSON, CSV (?format=csv) or PDF (?format=pdf)
+func getCustomerStatement(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, to, err := parsePeriod(r)
+		if err != nil {
+			http.Error(w, "from and to must be dates (2006-01-02) or RFC 3339 times", http.StatusBadRequest)
+			return
+		}
+
+		var customer CustomerGet
+		err = client.Database(Database).Collection("customer").FindOne(context.Background(), bson.M{"_id": oid}).Decode(&customer)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "customer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ledger, err := customerLedger(client, customer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statement := buildStatement(customer, ledger, from, to)
+
+		filename := "statement-" + id + "-" + from.Format("20060102") + "-" + to.Format("20060102")
+		if r.URL.Query().Get("format") == "csv" {
+			rows := [][]string{{from.Format(time.RFC3339), "opening", "", "Opening balance", "", "", formatMoney(statement.OpeningBalance)}}
+			for _, entry := range statement.Entries {
+				rows = append(rows, []string{entry.Date.Format(time.RFC3339), entry.Type, entry.Ref, entry.Description, formatMoney(entry.Debit), formatMoney(entry.Credit), formatMoney(entry.Balance)})
+			}
+			rows = append(rows, []string{to.Format(time.RFC3339), "closing", "", "Closing balance", "", "", formatMoney(statement.ClosingBalance)})
+			writeCSV(w, filename+".csv", []string{"date", "type", "ref", "description", "debit", "credit", "balance"}, rows)
+			return
+		}
+		if wantsPDF(r.URL.Query().Get("format"), r.Header.Get("Accept")) {
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", "inline; filename=\""+filename+".pdf\"")
+			w.Write(renderPDF("Account Statement", statementLines(statement)))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(statement)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
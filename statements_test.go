@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildStatement(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+	customer := CustomerGet{Name: "Asha Traders"}
+	ledger := []StatementEntry{
+		{Date: day(1), Type: "invoice", Ref: "INV-1", Debit: 100},
+		{Date: day(3), Type: "payment", Ref: "RCT-1", Credit: 40},
+		{Date: day(10), Type: "invoice", Ref: "INV-2", Debit: 25.5},
+		{Date: day(12), Type: "credit_note", Ref: "CN-1", Credit: 5.25},
+		{Date: day(20), Type: "invoice", Ref: "INV-3", Debit: 70},
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		opening  float64
+		entries  []StatementEntry
+		closing  float64
+	}{
+		{
+			name: "period in the middle",
+			from: day(5), to: day(15),
+			opening: 60,
+			entries: []StatementEntry{
+				{Date: day(10), Type: "invoice", Ref: "INV-2", Debit: 25.5, Balance: 85.5},
+				{Date: day(12), Type: "credit_note", Ref: "CN-1", Credit: 5.25, Balance: 80.25},
+			},
+			closing: 80.25,
+		},
+		{
+			name: "whole history",
+			from: day(1), to: day(31),
+			entries: []StatementEntry{
+				{Date: day(1), Type: "invoice", Ref: "INV-1", Debit: 100, Balance: 100},
+				{Date: day(3), Type: "payment", Ref: "RCT-1", Credit: 40, Balance: 60},
+				{Date: day(10), Type: "invoice", Ref: "INV-2", Debit: 25.5, Balance: 85.5},
+				{Date: day(12), Type: "credit_note", Ref: "CN-1", Credit: 5.25, Balance: 80.25},
+				{Date: day(20), Type: "invoice", Ref: "INV-3", Debit: 70, Balance: 150.25},
+			},
+			closing: 150.25,
+		},
+		{
+			name: "quiet period",
+			from: day(14), to: day(18),
+			opening: 80.25,
+			entries: []StatementEntry{},
+			closing: 80.25,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildStatement(customer, ledger, tt.from, tt.to)
+			if got.OpeningBalance != tt.opening || got.ClosingBalance != tt.closing {
+				t.Errorf("opening, closing = %v, %v; want %v, %v", got.OpeningBalance, got.ClosingBalance, tt.opening, tt.closing)
+			}
+			if !reflect.DeepEqual(got.Entries, tt.entries) {
+				t.Errorf("entries = %+v, want %+v", got.Entries, tt.entries)
+			}
+		})
+	}
+}
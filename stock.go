@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StockMovement records one change to an item's stock level
+type StockMovement struct {
+	ItemID            primitive.ObjectID `bson:"itemId" json:"itemId"`
+	VariantSKU        string             `bson:"variantSku,omitempty" json:"variantSku,omitempty"`
+	Qty               int64              `json:"qty"`
+	Reason            string             `json:"reason"`
+	Ref               string             `json:"ref"`
+	Note              string             `json:"note"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type StockMovementGet struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id,omitempty"`
+	ItemID            primitive.ObjectID `bson:"itemId" json:"itemId"`
+	VariantSKU        string             `bson:"variantSku,omitempty" json:"variantSku,omitempty"`
+	Qty               int64              `json:"qty"`
+	Reason            string             `json:"reason"`
+	Ref               string             `json:"ref"`
+	Note              string             `json:"note"`
+	Actor             string             `json:"actor"`
+	CapturedTimestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type StockAdjustment struct {
+	VariantSKU string `json:"variantSku"`
+	Qty        int64  `json:"qty"`
+	Note       string `json:"note"`
+}
+
+// StockKey identifies what stock is held against: an item, or one of its variants
+type StockKey struct {
+	ItemID     primitive.ObjectID
+	VariantSKU string
+}
+
+// lineQuantities totals the quantity of each item or variant across invoice lines
+func lineQuantities(lines []ItemGetInv) map[StockKey]int64 {
+	qty := map[StockKey]int64{}
+	for _, line := range lines {
+		qty[StockKey{ItemID: line.ID, VariantSKU: line.VariantSKU}] += line.Qty
+	}
+	return qty
+}
+
+// stockDeltas works out the stock change when an invoice's lines go from before to after.
+// Selling more takes stock out, selling less puts it back.
+func stockDeltas(before, after []ItemGetInv) map[StockKey]int64 {
+	deltas := map[StockKey]int64{}
+	for id, qty := range lineQuantities(before) {
+		deltas[id] += qty
+	}
+	for id, qty := range lineQuantities(after) {
+		deltas[id] -= qty
+	}
+	return deltas
+}
+
+// stockUpdate builds the filter and update that change the stock held against key
+func stockUpdate(key StockKey, qty int64) (bson.M, bson.M) {
+	if key.VariantSKU != "" {
+		return bson.M{"_id": key.ItemID, "variants.sku": key.VariantSKU}, bson.M{"$inc": bson.M{"variants.$.stock": qty, "version": 1}}
+	}
+	return bson.M{"_id": key.ItemID}, bson.M{"$inc": bson.M{"stock": qty, "version": 1}}
+}
+
+// moveStock applies stock changes to items and records a movement for each non-zero change
+func moveStock(client *mongo.Client, deltas map[StockKey]int64, reason string, ref string, actor string) error {
+	return moveStockWith(context.Background(), client.Database(Database), deltas, reason, ref, actor)
+}
+
+// moveStockWith is moveStock under ctx, so the changes can join a transaction
+func moveStockWith(ctx context.Context, db *mongo.Database, deltas map[StockKey]int64, reason string, ref string, actor string) error {
+	products := db.Collection("products")
+	movements := db.Collection("stockmovements")
+	for key, qty := range deltas {
+		if qty == 0 || key.ItemID.IsZero() {
+			continue
+		}
+		filter, update := stockUpdate(key, qty)
+		_, err := products.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		movement := StockMovement{ItemID: key.ItemID, VariantSKU: key.VariantSKU, Qty: qty, Reason: reason, Ref: ref, Actor: actor, CapturedTimestamp: time.Now()}
+		_, err = movements.InsertOne(ctx, movement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustStock records a manual stock adjustment such as a delivery or a stock count correction
+func adjustStock(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req StockAdjustment
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Qty == 0 {
+			http.Error(w, "qty must not be zero", http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("products")
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		filter, update := stockUpdate(StockKey{ItemID: oid, VariantSKU: req.VariantSKU}, req.Qty)
+		var item ItemGet
+		err = collection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&item)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "item or variant not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		movement := StockMovement{ItemID: oid, VariantSKU: req.VariantSKU, Qty: req.Qty, Reason: "adjustment", Note: req.Note, Actor: requestActor(r), CapturedTimestamp: time.Now()}
+		_, err = client.Database(Database).Collection("stockmovements").InsertOne(context.Background(), movement)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getStockMovements lists an item's stock movements, newest first
+func getStockMovements(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("stockmovements")
+		findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+		cursor, err := collection.Find(context.Background(), bson.M{"itemId": oid}, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []StockMovementGet
+		err = cursor.All(context.Background(), &items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// lowStock reports whether an item, or any of its variants, is at or below its reorder level
+func lowStock(item ItemGet) bool {
+	if len(item.Variants) == 0 {
+		return item.ReorderLevel > 0 && item.Stock <= item.ReorderLevel
+	}
+	for _, variant := range item.Variants {
+		if variant.ReorderLevel > 0 && variant.Stock <= variant.ReorderLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// getLowStockItems lists active items whose stock, or a variant's stock, has fallen to or below its reorder level
+func getLowStockItems(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := client.Database(Database).Collection("products")
+		filter := bson.M{
+			"status": bson.M{"$ne": "disabled"},
+			"$or":    bson.A{bson.M{"reorderlevel": bson.M{"$gt": 0}}, bson.M{"variants.reorderlevel": bson.M{"$gt": 0}}},
+		}
+		findOptions := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+		cursor, err := collection.Find(context.Background(), notDeleted(r, filter), findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var all []ItemGet
+		err = cursor.All(context.Background(), &all)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var items []ItemGet
+		for _, item := range all {
+			if lowStock(item) {
+				items = append(items, item)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(items)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
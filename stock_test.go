@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStockDeltas(t *testing.T) {
+	pen, ink := primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name          string
+		before, after []ItemGetInv
+		want          map[StockKey]int64
+	}{
+		{
+			name:  "new invoice takes stock out",
+			after: []ItemGetInv{{ID: pen, Qty: 3}, {ID: ink, Qty: 1}},
+			want:  map[StockKey]int64{{ItemID: pen}: -3, {ItemID: ink}: -1},
+		},
+		{
+			name:   "voided invoice puts stock back",
+			before: []ItemGetInv{{ID: pen, Qty: 3}},
+			want:   map[StockKey]int64{{ItemID: pen}: 3},
+		},
+		{
+			name:   "same item on several lines",
+			before: []ItemGetInv{{ID: pen, Qty: 2}, {ID: pen, Qty: 1}},
+			after:  []ItemGetInv{{ID: pen, Qty: 5}},
+			want:   map[StockKey]int64{{ItemID: pen}: -2},
+		},
+		{
+			name:   "edit lowers one line and keeps another",
+			before: []ItemGetInv{{ID: pen, Qty: 2}, {ID: ink, Qty: 4}},
+			after:  []ItemGetInv{{ID: pen, Qty: 2}, {ID: ink, Qty: 1}},
+			want:   map[StockKey]int64{{ItemID: pen}: 0, {ItemID: ink}: 3},
+		},
+		{
+			name:   "variants are counted apart",
+			before: []ItemGetInv{{ID: pen, VariantSKU: "PEN-BLU", Qty: 2}},
+			after:  []ItemGetInv{{ID: pen, VariantSKU: "PEN-RED", Qty: 2}, {ID: pen, Qty: 1}},
+			want:   map[StockKey]int64{{ItemID: pen, VariantSKU: "PEN-BLU"}: 2, {ItemID: pen, VariantSKU: "PEN-RED"}: -2, {ItemID: pen}: -1},
+		},
+		{
+			name: "no lines",
+			want: map[StockKey]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stockDeltas(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stockDeltas() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStockUpdate(t *testing.T) {
+	pen := primitive.NewObjectID()
+	tests := []struct {
+		name   string
+		key    StockKey
+		qty    int64
+		filter bson.M
+		update bson.M
+	}{
+		{
+			name:   "item",
+			key:    StockKey{ItemID: pen},
+			qty:    -3,
+			filter: bson.M{"_id": pen},
+			update: bson.M{"$inc": bson.M{"stock": int64(-3), "version": 1}},
+		},
+		{
+			name:   "variant",
+			key:    StockKey{ItemID: pen, VariantSKU: "PEN-BLU"},
+			qty:    5,
+			filter: bson.M{"_id": pen, "variants.sku": "PEN-BLU"},
+			update: bson.M{"$inc": bson.M{"variants.$.stock": int64(5), "version": 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, update := stockUpdate(tt.key, tt.qty)
+			if !reflect.DeepEqual(filter, tt.filter) {
+				t.Errorf("filter = %v, want %v", filter, tt.filter)
+			}
+			if !reflect.DeepEqual(update, tt.update) {
+				t.Errorf("update = %v, want %v", update, tt.update)
+			}
+		})
+	}
+}
+
+func TestLowStock(t *testing.T) {
+	tests := []struct {
+		name string
+		item ItemGet
+		want bool
+	}{
+		{name: "above reorder level", item: ItemGet{Stock: 10, ReorderLevel: 5}, want: false},
+		{name: "at reorder level", item: ItemGet{Stock: 5, ReorderLevel: 5}, want: true},
+		{name: "no reorder level", item: ItemGet{Stock: 0}, want: false},
+		{
+			name: "one variant low",
+			item: ItemGet{Variants: []Variant{{SKU: "A", Stock: 9, ReorderLevel: 2}, {SKU: "B", Stock: 1, ReorderLevel: 2}}},
+			want: true,
+		},
+		{
+			name: "variants ignore the item's own level",
+			item: ItemGet{Stock: 0, ReorderLevel: 5, Variants: []Variant{{SKU: "A", Stock: 9, ReorderLevel: 2}}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lowStock(tt.item); got != tt.want {
+				t.Errorf("lowStock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// stripeSignatureTolerance is how old a webhook signature may be before it is rejected
+const stripeSignatureTolerance = 5 * time.Minute
+
+var ErrStripeNotConfigured = errors.New("stripe is not configured")
+
+// stripeAPIURL is the Stripe API base, overridable through STRIPE_API_URL to point at a fake server
+func stripeAPIURL() string {
+	apiURL := os.Getenv("STRIPE_API_URL")
+	if apiURL == "" {
+		return "https://api.stripe.com"
+	}
+	return strings.TrimRight(apiURL, "/")
+}
+
+// stripeCurrency is the currency invoices are charged in, configurable through STRIPE_CURRENCY
+func stripeCurrency() string {
+	currency := os.Getenv("STRIPE_CURRENCY")
+	if currency == "" {
+		return "inr"
+	}
+	return strings.ToLower(currency)
+}
+
+// stripeMinorUnits converts an amount to the smallest currency unit Stripe expects
+func stripeMinorUnits(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+type StripeError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// stripePost sends a form-encoded POST to the Stripe API and decodes the JSON response into out
+func stripePost(path string, form url.Values, out interface{}) error {
+	secret := os.Getenv("STRIPE_SECRET_KEY")
+	if secret == "" {
+		return ErrStripeNotConfigured
+	}
+
+	req, err := http.NewRequest("POST", stripeAPIURL()+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var stripeErr StripeError
+		json.NewDecoder(resp.Body).Decode(&stripeErr)
+		return fmt.Errorf("stripe returned %d: %s", resp.StatusCode, stripeErr.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type StripePaymentIntent struct {
+	ID             string            `json:"id"`
+	ClientSecret   string            `json:"client_secret"`
+	Amount         int64             `json:"amount"`
+	AmountReceived int64             `json:"amount_received"`
+	Currency       string            `json:"currency"`
+	Status         string            `json:"status"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+type StripeCheckoutSession struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+type StripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// StripeEventRecord marks a webhook event as handled so redeliveries are ignored
+type StripeEventRecord struct {
+	ID         string    `bson:"_id" json:"id"`
+	Type       string    `bson:"type" json:"type"`
+	ReceivedAt time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// payableInvoice loads an invoice that Stripe should collect for and returns what is still due
+func payableInvoice(client *mongo.Client, id string) (InvoiceGet, float64, error) {
+	var invoice InvoiceGet
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return invoice, 0, fmt.Errorf("%w: %s", ErrInvalidPayment, err.Error())
+	}
+	err = client.Database(Database).Collection("invoices").FindOne(context.Background(), bson.M{"_id": oid}).Decode(&invoice)
+	if err == mongo.ErrNoDocuments {
+		return invoice, 0, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return invoice, 0, err
+	}
+	if invoice.Status == InvoiceDraft || invoice.Status == InvoiceVoid {
+		return invoice, 0, fmt.Errorf("%w: it is %s", ErrInvoiceNotPayable, invoice.Status)
+	}
+	due := invoiceDue(invoice)
+	if due <= 0 {
+		return invoice, 0, fmt.Errorf("%w: nothing is outstanding", ErrInvoiceNotPayable)
+	}
+	return invoice, due, nil
+}
+
+// stripeErrorStatus maps errors from the Stripe routes to HTTP statuses
+func stripeErrorStatus(err error) int {
+	if errors.Is(err, ErrStripeNotConfigured) {
+		return http.StatusServiceUnavailable
+	}
+	return paymentErrorStatus(err)
+}
+
+// createPaymentIntent creates a Stripe PaymentIntent for the outstanding amount of an invoice
+func createPaymentIntent(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		invoice, due, err := payableInvoice(client, id)
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), stripeErrorStatus(err))
+			return
+		}
+
+		form := url.Values{}
+		form.Set("amount", strconv.FormatInt(stripeMinorUnits(due), 10))
+		form.Set("currency", stripeCurrency())
+		form.Set("description", "Invoice "+invoice.Number)
+		form.Set("metadata[invoiceId]", id)
+		form.Set("metadata[custId]", invoice.CustomerID.Hex())
+
+		var intent StripePaymentIntent
+		err = stripePost("/v1/payment_intents", form, &intent)
+		if err != nil {
+			// Nothing is recorded here until Stripe reports the payment through the webhook
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), stripeErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]string{"id": intent.ID, "clientSecret": intent.ClientSecret})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// createCheckoutSession creates a Stripe Checkout session for the outstanding amount of an invoice.
+// The invoice is copied onto the session's PaymentIntent so the webhook can find it.
+func createCheckoutSession(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		invoice, due, err := payableInvoice(client, id)
+		if err != nil {
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), stripeErrorStatus(err))
+			return
+		}
+
+		form := url.Values{}
+		form.Set("mode", "payment")
+		form.Set("success_url", os.Getenv("STRIPE_SUCCESS_URL"))
+		form.Set("cancel_url", os.Getenv("STRIPE_CANCEL_URL"))
+		form.Set("line_items[0][quantity]", "1")
+		form.Set("line_items[0][price_data][currency]", stripeCurrency())
+		form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(stripeMinorUnits(due), 10))
+		form.Set("line_items[0][price_data][product_data][name]", "Invoice "+invoice.Number)
+		form.Set("payment_intent_data[metadata][invoiceId]", id)
+		form.Set("payment_intent_data[metadata][custId]", invoice.CustomerID.Hex())
+
+		var session StripeCheckoutSession
+		err = stripePost("/v1/checkout/sessions", form, &session)
+		if err != nil {
+			// Nothing is recorded here until Stripe reports the payment through the webhook
+			log.Println(err.Error())
+			releaseIdempotencyKey(w)
+			http.Error(w, err.Error(), stripeErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]string{"id": session.ID, "url": session.URL})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// verifyStripeSignature checks a Stripe-Signature header ("t=<unix>,v1=<hex>,...") against the payload
+func verifyStripeSignature(payload []byte, header string, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errors.New("malformed Stripe-Signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed Stripe-Signature timestamp")
+	}
+	if now.Sub(time.Unix(unix, 0)) > stripeSignatureTolerance {
+		return errors.New("Stripe-Signature timestamp is too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return errors.New("no matching Stripe signature")
+}
+
+// handlePaymentIntentSucceeded records a succeeded PaymentIntent against its invoice.
+// Checkout sessions carry the same metadata on their PaymentIntent, so this covers both flows.
+func handlePaymentIntentSucceeded(client *mongo.Client, raw json.RawMessage) error {
+	var intent StripePaymentIntent
+	err := json.Unmarshal(raw, &intent)
+	if err != nil {
+		return err
+	}
+	invoiceID := intent.Metadata["invoiceId"]
+	if invoiceID == "" {
+		log.Println("stripe: payment intent", intent.ID, "has no invoice, ignoring")
+		return nil
+	}
+	invoiceOid, err := primitive.ObjectIDFromHex(invoiceID)
+	if err != nil {
+		return err
+	}
+
+	// A PaymentIntent is only ever recorded once, whichever event delivered it, which the unique
+	// index on stripeid enforces. One whose capture failed part way is finished on Stripe's retry.
+	var existing PaymentCaptureGet
+	err = client.Database(Database).Collection("payments").FindOne(context.Background(), bson.M{"stripeid": intent.ID}).Decode(&existing)
+	if err == nil {
+		return finishPayment(client, existing.ID, "stripe")
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	item := PaymentCapture{
+		CustomerID:        intent.Metadata["custId"],
+		Amount:            float64(intent.AmountReceived) / 100,
+		StripeID:          intent.ID,
+		Mode:              "stripe",
+		CapturedTimestamp: time.Now(),
+	}
+	_, err = captureInvoicePayment(client, invoiceOid, &item, "stripe")
+	if (errors.Is(err, ErrInvoiceNotPayable) || errors.Is(err, ErrInvoiceNotFound)) && item.CustomerID != "" {
+		// The money has been taken either way, so post it to the customer's open invoices or credit
+		log.Println("stripe: payment intent", intent.ID, err.Error(), "- posting to the customer instead")
+		item.Allocations = nil
+		_, err = capturePayment(client, &item, "stripe")
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		// Another delivery recorded it first and finishes it
+		return nil
+	}
+	return err
+}
+
+// stripeWebhook receives Stripe events. Each event id is recorded before it is handled so a
+// redelivered event is acknowledged without posting the payment twice; if handling fails the
+// record is removed again so Stripe's retry is processed and finishes the payment.
+func stripeWebhook(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+		if secret == "" {
+			http.Error(w, ErrStripeNotConfigured.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = verifyStripeSignature(payload, r.Header.Get("Stripe-Signature"), secret, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var event StripeEvent
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("stripeevents")
+		_, err = collection.InsertOne(context.Background(), StripeEventRecord{ID: event.ID, Type: event.Type, ReceivedAt: time.Now()})
+		if mongo.IsDuplicateKeyError(err) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch event.Type {
+		case "payment_intent.succeeded":
+			err = handlePaymentIntentSucceeded(client, event.Data.Object)
+		}
+		if err != nil {
+			log.Println("stripe:", event.ID, err.Error())
+			collection.DeleteOne(context.Background(), bson.M{"_id": event.ID})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
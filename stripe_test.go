@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// stripeTestSignature signs a payload the way Stripe does for a Stripe-Signature header
+func stripeTestSignature(payload, secret string, at time.Time) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d.%s", at.Unix(), payload)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	const secret = "whsec_test"
+	const payload = `{"id":"evt_1","type":"payment_intent.succeeded"}`
+	now := time.Unix(1700000000, 0)
+	signed := now.Add(-time.Minute)
+	valid := stripeTestSignature(payload, secret, signed)
+
+	tests := []struct {
+		name    string
+		payload string
+		header  string
+		wantErr bool
+	}{
+		{name: "valid", payload: payload, header: fmt.Sprintf("t=%d,v1=%s", signed.Unix(), valid)},
+		{name: "valid among several signatures", payload: payload, header: fmt.Sprintf("t=%d, v1=%s, v1=%s, v0=abc", signed.Unix(), stripeTestSignature(payload, "whsec_old", signed), valid)},
+		{name: "wrong secret", payload: payload, header: fmt.Sprintf("t=%d,v1=%s", signed.Unix(), stripeTestSignature(payload, "whsec_other", signed)), wantErr: true},
+		{name: "tampered payload", payload: `{"id":"evt_2","type":"payment_intent.succeeded"}`, header: fmt.Sprintf("t=%d,v1=%s", signed.Unix(), valid), wantErr: true},
+		{name: "timestamp changed", payload: payload, header: fmt.Sprintf("t=%d,v1=%s", signed.Unix()+1, valid), wantErr: true},
+		{name: "too old", payload: payload, header: fmt.Sprintf("t=%d,v1=%s", now.Add(-10*time.Minute).Unix(), stripeTestSignature(payload, secret, now.Add(-10*time.Minute))), wantErr: true},
+		{name: "missing timestamp", payload: payload, header: "v1=" + valid, wantErr: true},
+		{name: "missing signature", payload: payload, header: fmt.Sprintf("t=%d", signed.Unix()), wantErr: true},
+		{name: "malformed timestamp", payload: payload, header: "t=yesterday,v1=" + valid, wantErr: true},
+		{name: "signature not hex", payload: payload, header: fmt.Sprintf("t=%d,v1=zz", signed.Unix()), wantErr: true},
+		{name: "empty header", payload: payload, header: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyStripeSignature([]byte(tt.payload), tt.header, secret, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyStripeSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TaxSummary totals the taxable value and tax charged at one rate
+type TaxSummary struct {
+	Rate    float64 `json:"rate"`
+	Taxable float64 `json:"taxable"`
+	Tax     float64 `json:"tax"`
+}
+
+// InvoiceTotals is the server-side calculation of an invoice's amounts
+type InvoiceTotals struct {
+	DiscountTotal float64
+	Subtotal      float64
+	TaxTotal      float64
+	Taxes         []TaxSummary
+	Total         float64
+}
+
+// categoryTaxRates works out the tax rate of every category. A category without its own rate
+// takes the rate of its nearest ancestor that has one, and defaults to zero.
+func categoryTaxRates(client *mongo.Client) (map[primitive.ObjectID]float64, error) {
+	categories, err := loadCategories(client)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[primitive.ObjectID]CategoryGet{}
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+	rates := map[primitive.ObjectID]float64{}
+	for _, category := range categories {
+		current := category
+		for depth := 0; depth <= len(categories); depth++ {
+			if current.TaxRate != nil {
+				rates[category.ID] = *current.TaxRate
+				break
+			}
+			parent, ok := byID[current.ParentID]
+			if !ok {
+				break
+			}
+			current = parent
+		}
+	}
+	return rates, nil
+}
+
+// taxLine fills in the taxable value, tax and gross total of one invoice line after its discount.
+// Inclusive prices already contain the tax, exclusive prices have it added on top.
+func taxLine(line *ItemGetInv) {
+	amount := roundMoney(line.Price*float64(line.Qty) - line.DiscountAmount)
+	if line.TaxInclusive {
+		line.Taxable = roundMoney(amount / (1 + line.TaxRate/100))
+		line.Tax = roundMoney(amount - line.Taxable)
+	} else {
+		line.Taxable = amount
+		line.Tax = roundMoney(amount * line.TaxRate / 100)
+	}
+	line.TotalP = roundMoney(line.Taxable + line.Tax)
+}
+
+// summarizeTaxes totals already taxed lines into the invoice subtotal, tax per rate and total
+func summarizeTaxes(lines []ItemGetInv) InvoiceTotals {
+	var totals InvoiceTotals
+	byRate := map[float64]*TaxSummary{}
+	for _, line := range lines {
+		totals.DiscountTotal += line.DiscountAmount
+		totals.Subtotal += line.Taxable
+		totals.TaxTotal += line.Tax
+		summary, ok := byRate[line.TaxRate]
+		if !ok {
+			summary = &TaxSummary{Rate: line.TaxRate}
+			byRate[line.TaxRate] = summary
+		}
+		summary.Taxable = roundMoney(summary.Taxable + line.Taxable)
+		summary.Tax = roundMoney(summary.Tax + line.Tax)
+	}
+	for _, summary := range byRate {
+		totals.Taxes = append(totals.Taxes, *summary)
+	}
+	sort.Slice(totals.Taxes, func(i, j int) bool { return totals.Taxes[i].Rate < totals.Taxes[j].Rate })
+	totals.DiscountTotal = roundMoney(totals.DiscountTotal)
+	totals.Subtotal = roundMoney(totals.Subtotal)
+	totals.TaxTotal = roundMoney(totals.TaxTotal)
+	totals.Total = roundMoney(totals.Subtotal + totals.TaxTotal)
+	return totals
+}
+
+// taxInvoiceLines looks up the tax rate and pricing mode of each line's item and taxes the line.
+// Lines that are not linked to an item keep the rate and mode they were given.
+func taxInvoiceLines(client *mongo.Client, lines []ItemGetInv) error {
+	var ids []primitive.ObjectID
+	for _, line := range lines {
+		if !line.ID.IsZero() {
+			ids = append(ids, line.ID)
+		}
+	}
+	items := map[primitive.ObjectID]ItemGet{}
+	if len(ids) > 0 {
+		cursor, err := client.Database(Database).Collection("products").Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		var found []ItemGet
+		err = cursor.All(context.Background(), &found)
+		if err != nil {
+			return err
+		}
+		for _, item := range found {
+			items[item.ID] = item
+		}
+	}
+	rates, err := categoryTaxRates(client)
+	if err != nil {
+		return err
+	}
+
+	for i := range lines {
+		if item, ok := items[lines[i].ID]; ok {
+			lines[i].TaxRate = rates[item.CategoryID]
+			lines[i].TaxInclusive = item.TaxInclusive
+		}
+		taxLine(&lines[i])
+	}
+	return nil
+}
+
+// calculateInvoice prices, discounts and taxes a customer's invoice lines as of the invoice date
+// and returns its totals
+func calculateInvoice(client *mongo.Client, custID primitive.ObjectID, lines []ItemGetInv, at time.Time, discounts ...*Discount) (InvoiceTotals, error) {
+	err := priceInvoiceLines(client, custID, lines, at)
+	if err != nil {
+		return InvoiceTotals{}, err
+	}
+	err = discountInvoiceLines(lines, discounts...)
+	if err != nil {
+		return InvoiceTotals{}, err
+	}
+	err = taxInvoiceLines(client, lines)
+	if err != nil {
+		return InvoiceTotals{}, err
+	}
+	return summarizeTaxes(lines), nil
+}
+
+// parseDate reads a date query parameter given as 2006-01-02 or RFC 3339. A bare date used as the
+// end of a period covers the whole of that day.
+func parseDate(value string, endOfDay bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// parsePeriod reads the ?from= and ?to= query parameters, defaulting to the current month
+func parsePeriod(r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	to := from.AddDate(0, 1, 0).Add(-time.Nanosecond)
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		from, err = parseDate(value, false)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		to, err = parseDate(value, true)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+// getTaxReport totals tax charged per rate on invoices issued in a period (?from=&to=), as JSON or
+// CSV (?format=csv). Drafts and void invoices are left out.
+func getTaxReport(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := parsePeriod(r)
+		if err != nil {
+			http.Error(w, "from and to must be dates (2006-01-02) or RFC 3339 times", http.StatusBadRequest)
+			return
+		}
+
+		collection := client.Database(Database).Collection("invoices")
+		filter := bson.M{
+			"timestamp": bson.M{"$gte": from, "$lte": to},
+			"status":    bson.M{"$nin": bson.A{InvoiceDraft, InvoiceVoid}},
+		}
+		findOptions := options.Find().SetProjection(bson.M{"items": 1})
+		cursor, err := collection.Find(context.Background(), filter, findOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var invoices []InvoiceGet
+		err = cursor.All(context.Background(), &invoices)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var lines []ItemGetInv
+		for _, invoice := range invoices {
+			for _, line := range invoice.Items {
+				// Lines from before tax was calculated count as untaxed at their line total
+				if line.Taxable == 0 && line.Tax == 0 {
+					line.Taxable = line.TotalP
+				}
+				lines = append(lines, line)
+			}
+		}
+		totals := summarizeTaxes(lines)
+
+		if r.URL.Query().Get("format") == "csv" {
+			var rows [][]string
+			for _, summary := range totals.Taxes {
+				rows = append(rows, []string{strconv.FormatFloat(summary.Rate, 'f', -1, 64), formatMoney(summary.Taxable), formatMoney(summary.Tax)})
+			}
+			rows = append(rows, []string{"total", formatMoney(totals.Subtotal), formatMoney(totals.TaxTotal)})
+			writeCSV(w, "tax-report.csv", []string{"rate", "taxable", "tax"}, rows)
+			return
+		}
+
+		report := map[string]interface{}{
+			"from":     from,
+			"to":       to,
+			"invoices": len(invoices),
+			"taxable":  totals.Subtotal,
+			"tax":      totals.TaxTotal,
+			"rates":    totals.Taxes,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
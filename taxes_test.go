@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTaxLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    ItemGetInv
+		taxable float64
+		tax     float64
+		total   float64
+	}{
+		{
+			name:    "exclusive",
+			line:    ItemGetInv{Price: 100, Qty: 2, TaxRate: 18},
+			taxable: 200, tax: 36, total: 236,
+		},
+		{
+			name:    "inclusive",
+			line:    ItemGetInv{Price: 118, Qty: 1, TaxRate: 18, TaxInclusive: true},
+			taxable: 100, tax: 18, total: 118,
+		},
+		{
+			name:    "inclusive after discount",
+			line:    ItemGetInv{Price: 59, Qty: 2, TaxRate: 18, TaxInclusive: true, DiscountAmount: 18},
+			taxable: 84.75, tax: 15.25, total: 100,
+		},
+		{
+			name:    "exclusive rounded to cents",
+			line:    ItemGetInv{Price: 19.99, Qty: 1, TaxRate: 12.5},
+			taxable: 19.99, tax: 2.5, total: 22.49,
+		},
+		{
+			name:    "no tax",
+			line:    ItemGetInv{Price: 10.5, Qty: 3},
+			taxable: 31.5, tax: 0, total: 31.5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := tt.line
+			taxLine(&line)
+			if line.Taxable != tt.taxable || line.Tax != tt.tax || line.TotalP != tt.total {
+				t.Errorf("taxable, tax, total = %v, %v, %v; want %v, %v, %v", line.Taxable, line.Tax, line.TotalP, tt.taxable, tt.tax, tt.total)
+			}
+		})
+	}
+}
+
+func TestSummarizeTaxes(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []ItemGetInv
+		want  InvoiceTotals
+	}{
+		{
+			name: "inclusive and exclusive at the same rate",
+			lines: []ItemGetInv{
+				{Price: 100, Qty: 2, TaxRate: 18},
+				{Price: 118, Qty: 1, TaxRate: 18, TaxInclusive: true},
+				{Price: 30, Qty: 2, TaxRate: 5, DiscountAmount: 10},
+			},
+			want: InvoiceTotals{
+				DiscountTotal: 10,
+				Subtotal:      350,
+				TaxTotal:      56.5,
+				Taxes:         []TaxSummary{{Rate: 5, Taxable: 50, Tax: 2.5}, {Rate: 18, Taxable: 300, Tax: 54}},
+				Total:         406.5,
+			},
+		},
+		{
+			name:  "no lines",
+			lines: nil,
+			want:  InvoiceTotals{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.lines {
+				taxLine(&tt.lines[i])
+			}
+			got := summarizeTaxes(tt.lines)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summarizeTaxes() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Items, customers, invoices and payments carry a version that every write to them increments.
+// GET returns it as the ETag and PUT must send it back in If-Match, so an edit made from a stale
+// copy is refused instead of overwriting someone else's change. Documents written before versions
+// existed count as version 0.
+
+var ErrPreconditionRequired = errors.New("If-Match with the ETag from GET is required")
+var ErrInvalidETag = errors.New("If-Match is not an ETag from GET")
+
+// etag formats a version as a strong ETag
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// setETag sends the version of a single record as its ETag
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", etag(version))
+}
+
+// ifMatchVersion reads the version the client is editing from If-Match
+func ifMatchVersion(r *http.Request) (int64, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" {
+		return 0, ErrPreconditionRequired
+	}
+	value = strings.TrimPrefix(value, "W/")
+	version, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || version < 0 {
+		return 0, ErrInvalidETag
+	}
+	return version, nil
+}
+
+// writeVersionError answers a missing or unreadable If-Match
+func writeVersionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrPreconditionRequired) {
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// versionFilter limits filter to the given version of the record
+func versionFilter(filter bson.M, version int64) bson.M {
+	if version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	} else {
+		filter["version"] = version
+	}
+	return filter
+}
+
+// bumpVersion adds incrementing the version to an update
+func bumpVersion(update bson.M) bson.M {
+	inc, ok := update["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+		update["$inc"] = inc
+	}
+	inc["version"] = 1
+	return update
+}
+
+// writeStale answers an edit made from an old version with 412 and the record as it is now
+func writeStale(w http.ResponseWriter, current interface{}, version int64) {
+	setETag(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(current)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		want    int64
+		err     error
+	}{
+		{name: "etag from GET", ifMatch: etag(7), want: 7},
+		{name: "weak etag", ifMatch: `W/"7"`, want: 7},
+		{name: "unquoted", ifMatch: " 12 ", want: 12},
+		{name: "version 0", ifMatch: `"0"`, want: 0},
+		{name: "missing", ifMatch: "", err: ErrPreconditionRequired},
+		{name: "wildcard", ifMatch: "*", err: ErrInvalidETag},
+		{name: "negative", ifMatch: `"-1"`, err: ErrInvalidETag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/customer/1", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			got, err := ifMatchVersion(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ifMatchVersion() error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ifMatchVersion() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteVersionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: ErrPreconditionRequired, want: http.StatusPreconditionRequired},
+		{err: ErrInvalidETag, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeVersionError(w, tt.err)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int64
+		want    bson.M
+	}{
+		{name: "written before versions existed", version: 0, want: bson.M{"_id": 1, "version": bson.M{"$in": bson.A{0, nil}}}},
+		{name: "versioned", version: 3, want: bson.M{"_id": 1, "version": int64(3)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := versionFilter(bson.M{"_id": 1}, tt.version); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("versionFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBumpVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		update bson.M
+		want   bson.M
+	}{
+		{
+			name:   "set only",
+			update: bson.M{"$set": bson.M{"name": "Asha"}},
+			want:   bson.M{"$set": bson.M{"name": "Asha"}, "$inc": bson.M{"version": 1}},
+		},
+		{
+			name:   "keeps other increments",
+			update: bson.M{"$inc": bson.M{"balance": 25.0}},
+			want:   bson.M{"$inc": bson.M{"balance": 25.0, "version": 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bumpVersion(tt.update); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bumpVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteStale(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeStale(w, map[string]string{"name": "Asha"}, 4)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if got := w.Header().Get("ETag"); got != `"4"` {
+		t.Errorf("ETag = %s, want \"4\"", got)
+	}
+	if got := w.Body.String(); got != "{\"name\":\"Asha\"}\n" {
+		t.Errorf("body = %q", got)
+	}
+}